@@ -0,0 +1,60 @@
+// Command resources inspects resource directories.
+//
+// Usage:
+//
+//	resources lint [-strict] [directory...]
+//
+// lint prints every diagnostic found while loading the resources.ini in each
+// resource pack directory (default "resources"), overlaid in order. It exits
+// non-zero if the resources couldn't be loaded, which with -strict includes
+// there being any diagnostics.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bluepeppers/danckelmann/resources/resconfig"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s lint [-strict] [directory...]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "lint":
+		os.Exit(lint(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+func lint(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	strict := flags.Bool("strict", false, "fail if there are any diagnostics, rather than only if loading fails")
+	flags.Parse(args)
+
+	roots := flags.Args()
+	if len(roots) == 0 {
+		roots = []string{"resources"}
+	}
+
+	conf, diags, ok := resconfig.LoadResourcePacks(roots, *strict)
+	for _, diag := range diags {
+		fmt.Println(diag)
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "could not load resources from %q\n", roots)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%v tiles, %v fonts, %v diagnostics\n",
+		len(conf.TileConfigs), len(conf.FontConfigs), len(diags))
+	return 0
+}
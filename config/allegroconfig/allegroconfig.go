@@ -0,0 +1,113 @@
+// Reads options that need allegro types, such as colours and keycodes, from a
+// config.Source. Allegro's own config can be passed anywhere a config.Source
+// is wanted, as it has the same Get method.
+package allegroconfig
+
+import (
+	"image/color"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bluepeppers/allegro"
+
+	"github.com/bluepeppers/danckelmann/config"
+)
+
+// Allegro's config is one source options can be read from
+var _ config.Source = (*allegro.Config)(nil)
+
+// Loads the config file with allegro. See config.LoadFile for loading without
+// allegro.
+func Load(fname string) (config.Source, bool) {
+	conf := allegro.LoadConfig(fname)
+	if conf == nil {
+		return nil, false
+	}
+	return conf, true
+}
+
+// As config.GetColor, converted to an allegro colour
+func GetColor(conf config.Source, sec, key string, def allegro.Color) allegro.Color {
+	r, g, b, a := def.GetRGBA()
+	c := config.GetColor(conf, sec, key, color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a)})
+	return allegro.CreateColor(int(c.R), int(c.G), int(c.B), int(c.A))
+}
+
+// Parses the name of a key, such as "A", "F1", "Escape" or "KEY_PGUP", into
+// its allegro keycode. Names are not case sensitive.
+func GetKey(conf config.Source, sec, key string, def int) int {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return def
+	}
+	val, ok := parseKey(vals)
+	if !ok {
+		log.Printf("%s.%s=%q not the name of a key", sec, key, vals)
+		log.Printf("Defaulting to %s.%s=%s", sec, key, keyName(def))
+		return def
+	}
+	return val
+}
+
+func parseKey(s string) (int, bool) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	name = strings.TrimPrefix(name, "KEY_")
+	code, ok := KEY_CODES[name]
+	return code, ok
+}
+
+// The name GetKey parses as the keycode, or the number if it has none. Where
+// a keycode has several names, the first alphabetically is used.
+func keyName(code int) string {
+	names := make([]string, 0, len(KEY_CODES))
+	for name := range KEY_CODES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if KEY_CODES[name] == code {
+			return name
+		}
+	}
+	return strconv.Itoa(code)
+}
+
+// The allegro keycodes GetKey understands, by name without the KEY_ prefix
+var KEY_CODES = map[string]int{
+	"A": int(allegro.KEY_A), "B": int(allegro.KEY_B), "C": int(allegro.KEY_C),
+	"D": int(allegro.KEY_D), "E": int(allegro.KEY_E), "F": int(allegro.KEY_F),
+	"G": int(allegro.KEY_G), "H": int(allegro.KEY_H), "I": int(allegro.KEY_I),
+	"J": int(allegro.KEY_J), "K": int(allegro.KEY_K), "L": int(allegro.KEY_L),
+	"M": int(allegro.KEY_M), "N": int(allegro.KEY_N), "O": int(allegro.KEY_O),
+	"P": int(allegro.KEY_P), "Q": int(allegro.KEY_Q), "R": int(allegro.KEY_R),
+	"S": int(allegro.KEY_S), "T": int(allegro.KEY_T), "U": int(allegro.KEY_U),
+	"V": int(allegro.KEY_V), "W": int(allegro.KEY_W), "X": int(allegro.KEY_X),
+	"Y": int(allegro.KEY_Y), "Z": int(allegro.KEY_Z),
+
+	"0": int(allegro.KEY_0), "1": int(allegro.KEY_1), "2": int(allegro.KEY_2),
+	"3": int(allegro.KEY_3), "4": int(allegro.KEY_4), "5": int(allegro.KEY_5),
+	"6": int(allegro.KEY_6), "7": int(allegro.KEY_7), "8": int(allegro.KEY_8),
+	"9": int(allegro.KEY_9),
+
+	"F1": int(allegro.KEY_F1), "F2": int(allegro.KEY_F2), "F3": int(allegro.KEY_F3),
+	"F4": int(allegro.KEY_F4), "F5": int(allegro.KEY_F5), "F6": int(allegro.KEY_F6),
+	"F7": int(allegro.KEY_F7), "F8": int(allegro.KEY_F8), "F9": int(allegro.KEY_F9),
+	"F10": int(allegro.KEY_F10), "F11": int(allegro.KEY_F11), "F12": int(allegro.KEY_F12),
+
+	"ESCAPE": int(allegro.KEY_ESCAPE), "TAB": int(allegro.KEY_TAB),
+	"BACKSPACE": int(allegro.KEY_BACKSPACE), "ENTER": int(allegro.KEY_ENTER),
+	"SPACE": int(allegro.KEY_SPACE), "INSERT": int(allegro.KEY_INSERT),
+	"DELETE": int(allegro.KEY_DELETE), "HOME": int(allegro.KEY_HOME),
+	"END": int(allegro.KEY_END), "PGUP": int(allegro.KEY_PGUP),
+	"PGDN": int(allegro.KEY_PGDN), "LEFT": int(allegro.KEY_LEFT),
+	"RIGHT": int(allegro.KEY_RIGHT), "UP": int(allegro.KEY_UP),
+	"DOWN": int(allegro.KEY_DOWN), "MINUS": int(allegro.KEY_MINUS),
+	"EQUALS": int(allegro.KEY_EQUALS), "PAD_PLUS": int(allegro.KEY_PAD_PLUS),
+	"PAD_MINUS": int(allegro.KEY_PAD_MINUS),
+
+	"LSHIFT": int(allegro.KEY_LSHIFT), "RSHIFT": int(allegro.KEY_RSHIFT),
+	"LCTRL": int(allegro.KEY_LCTRL), "RCTRL": int(allegro.KEY_RCTRL),
+	"ALT": int(allegro.KEY_ALT), "ALTGR": int(allegro.KEY_ALTGR),
+}
@@ -2,13 +2,14 @@ package config
 
 import (
 	"fmt"
+	"image/color"
 	"log"
-	"os"
-
-	"github.com/bluepeppers/allegro"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func GetString(conf *allegro.Config, sec, key string, def string) string {
+func GetString(conf Source, sec, key string, def string) string {
 	val, ok := conf.Get(sec, key)
 	if !ok {
 		return def
@@ -16,7 +17,7 @@ func GetString(conf *allegro.Config, sec, key string, def string) string {
 	return val
 }
 
-func GetInt(conf *allegro.Config, sec, key string, def int) int {
+func GetInt(conf Source, sec, key string, def int) int {
 	var val int
 	vals, ok := conf.Get(sec, key)
 	// Don't want to log something for every missing option
@@ -32,7 +33,7 @@ func GetInt(conf *allegro.Config, sec, key string, def int) int {
 	return val
 }
 
-func GetBool(conf *allegro.Config, sec, key string, def bool) bool {
+func GetBool(conf Source, sec, key string, def bool) bool {
 	var val bool
 	vals, ok := conf.Get(sec, key)
 	if !ok {
@@ -47,15 +48,184 @@ func GetBool(conf *allegro.Config, sec, key string, def bool) bool {
 	return val
 }
 
-func exists(fname string) bool {
-	_, err := os.Open(fname)
-	return !os.IsNotExist(err)
+func GetFloat(conf Source, sec, key string, def float64) float64 {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return def
+	}
+	val, err := strconv.ParseFloat(strings.TrimSpace(vals), 64)
+	if err != nil {
+		log.Printf("%s.%s=%q not parseable as float", sec, key, vals)
+		log.Printf("Defaulting to %s.%s=%v", sec, key, def)
+		return def
+	}
+	return val
+}
+
+// Parses durations such as "250ms" or "1m30s"
+func GetDuration(conf Source, sec, key string, def time.Duration) time.Duration {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return def
+	}
+	val, err := time.ParseDuration(strings.TrimSpace(vals))
+	if err != nil {
+		log.Printf("%s.%s=%q not parseable as duration", sec, key, vals)
+		log.Printf("Defaulting to %s.%s=%v", sec, key, def)
+		return def
+	}
+	return val
+}
+
+// Parses colours as #rrggbb or #rrggbbaa in hex, or r,g,b or r,g,b,a with
+// each component from 0 to 255. Alpha defaults to opaque. See
+// allegroconfig.GetColor for allegro colours.
+func GetColor(conf Source, sec, key string, def color.RGBA) color.RGBA {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return def
+	}
+	val, ok := parseColor(vals)
+	if !ok {
+		log.Printf("%s.%s=%q not parseable as colour", sec, key, vals)
+		log.Printf("Defaulting to %s.%s=%d,%d,%d,%d", sec, key, def.R, def.G, def.B, def.A)
+		return def
+	}
+	return val
+}
+
+func parseColor(s string) (color.RGBA, bool) {
+	var none color.RGBA
+	s = strings.TrimSpace(s)
+	var c [4]uint64
+	c[3] = 255
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) != 6 && len(hex) != 8 {
+			return none, false
+		}
+		for i := 0; i < len(hex)/2; i++ {
+			n, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+			if err != nil {
+				return none, false
+			}
+			c[i] = n
+		}
+	} else {
+		parts := strings.Split(s, ",")
+		if len(parts) != 3 && len(parts) != 4 {
+			return none, false
+		}
+		for i, part := range parts {
+			n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+			if err != nil {
+				return none, false
+			}
+			c[i] = n
+		}
+	}
+	return color.RGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), uint8(c[3])}, true
+}
+
+// Parses a comma separated list, trimming space around each item and dropping
+// empty ones
+func GetStringList(conf Source, sec, key string, def []string) []string {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return def
+	}
+	return parseStringList(vals)
+}
+
+func parseStringList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Parses a pair of integers as x,y, as used for positions and sizes in
+// resources.ini
+func GetIntPair(conf Source, sec, key string, defX, defY int) (int, int) {
+	vals, ok := conf.Get(sec, key)
+	if !ok {
+		return defX, defY
+	}
+	x, y, ok := ParseIntPair(vals)
+	if !ok {
+		log.Printf("%s.%s=%q not parseable as x,y", sec, key, vals)
+		log.Printf("Defaulting to %s.%s=%d,%d", sec, key, defX, defY)
+		return defX, defY
+	}
+	return x, y
+}
+
+// Parses x,y, with optional spaces around either number
+func ParseIntPair(s string) (int, int, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	x, errX := strconv.Atoi(strings.TrimSpace(parts[0]))
+	y, errY := strconv.Atoi(strings.TrimSpace(parts[1]))
+	return x, y, errX == nil && errY == nil
+}
+
+// The display section of the user's config
+type DisplaySettings struct {
+	Windowed string `ini:"display.windowed" default:"fullscreenwindow" enum:"fullscreen,fullscreenwindow,windowed"`
+	Width    int    `ini:"display.width" default:"600" min:"320"`
+	Height   int    `ini:"display.height" default:"400" min:"240"`
+	// -1 for the default monitor
+	Monitor int  `ini:"display.monitor" default:"-1" min:"-1"`
+	VSync   bool `ini:"display.vsync" default:"true"`
+	Samples int  `ini:"display.samples" default:"0" min:"0" max:"16"`
+	// In Hz, or 0 for any
+	Refresh int `ini:"display.refresh" default:"0" min:"0"`
+}
+
+// The resources section of the user's config
+type ResourceSettings struct {
+	Strict bool `ini:"resources.strict" default:"false"`
+	// Comma separated resource pack directories, overlaid in order
+	Packs           string `ini:"resources.packs" default:""`
+	TextureBudgetMB int    `ini:"resources.texture_budget_mb" default:"0" min:"0"`
+}
+
+// Every option the engine reads from the user's config
+type UserConfig struct {
+	Display   DisplaySettings
+	Resources ResourceSettings
+
+	// The config the settings were read from, for options games add
+	Raw Source
+	// The settings as of the last Save, which the next one writes the
+	// changes since
+	saved map[string]string
+}
+
+// Reads the settings from the config. Invalid options are set to their
+// defaults, and returned as Errors.
+func ReadUserConfig(conf Source) (*UserConfig, error) {
+	user := &UserConfig{Raw: conf}
+	return user, Fill(conf, user)
 }
 
-func LoadUserConfig(configLocation string) *allegro.Config {
-	fname := os.ExpandEnv(configLocation)
-	if exists(fname) {
-		return allegro.LoadConfig(fname)
+// Loads the system config at SYSTEM_CONFIG_LOCATION and then the user's config
+// file, where they exist, over the defaults, and overrides them with any
+// DANCKELMANN_SECTION_KEY environment variables and then the overrides, as
+// section.key=value from -set flags. Raw is the resulting *LayeredConfig, which
+// can say where each setting came from. The settings are usable even if an
+// error is returned.
+func LoadUserConfig(configLocation string, overrides ...string) (*UserConfig, error) {
+	loader := Loader{
+		SystemFile: SYSTEM_CONFIG_LOCATION,
+		UserFile:   configLocation,
+		Overrides:  overrides,
 	}
-	return allegro.CreateConfig()
+	return loader.LoadUser()
 }
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestParseIntPair(t *testing.T) {
+	tests := []struct {
+		s    string
+		x, y int
+		ok   bool
+	}{
+		{"1,2", 1, 2, true},
+		{" 10 , -20 ", 10, -20, true},
+		{"1;2", 0, 0, false},
+		{"1,2,3", 0, 0, false},
+		{"1,", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		x, y, ok := ParseIntPair(test.s)
+		if ok != test.ok || (ok && (x != test.x || y != test.y)) {
+			t.Errorf("ParseIntPair(%q) = %v, %v, %v, want %v, %v, %v", test.s, x, y, ok,
+				test.x, test.y, test.ok)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Somewhere config options can be read from. Implemented by File, and by
+// allegro's config, so that code reading options doesn't need allegro.
+type Source interface {
+	// The value of the key, and whether it was found. The global section
+	// is "".
+	Get(section, key string) (string, bool)
+}
+
+// A Source that can also list its sections, such as a File
+type SectionedSource interface {
+	Source
+	// The sections with options in them, in order
+	Sections() []string
+}
+
+// A line of an INI file. Lines are kept as they were read, so that writing
+// the file back out preserves comments, blank lines and key order.
+type iniLine struct {
+	text string
+	// The section the line is in, "" for the global section
+	section string
+	// Set if the line is a key = value pair
+	key string
+	// Set if the line is a [section] header
+	header bool
+}
+
+// The value of a key = value line
+func (line iniLine) value() string {
+	return strings.TrimSpace(line.text[strings.Index(line.text, "=")+1:])
+}
+
+// Whether the line is the key's key = value pair. Comments, blank lines and
+// headers define no key, and there is no empty key.
+func (line iniLine) defines(section, key string) bool {
+	return key != "" && line.key == key && line.section == section
+}
+
+// An INI file, in allegro's format: [section] headers, key = value pairs, and
+// comments starting with #. Parsed in pure Go, so usable without allegro.
+type File struct {
+	lines []iniLine
+}
+
+// Loads the file, expanding environment variables in its name
+func LoadFile(fname string) (*File, error) {
+	fname = os.ExpandEnv(fname)
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not load config file %q: %w", fname, err)
+	}
+	return ParseINI(string(data)), nil
+}
+
+// Parses the text of an INI file. Lines that aren't headers, comments or
+// key = value pairs are kept but ignored, as allegro does.
+func ParseINI(text string) *File {
+	doc := &File{}
+	section := ""
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return doc
+	}
+	for _, raw := range strings.Split(text, "\n") {
+		line := iniLine{text: raw, section: section}
+		trimmed := strings.TrimSpace(raw)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			line.section = section
+			line.header = true
+		default:
+			if i := strings.Index(trimmed, "="); i >= 0 {
+				line.key = strings.TrimSpace(trimmed[:i])
+			}
+		}
+		doc.lines = append(doc.lines, line)
+	}
+	return doc
+}
+
+// The value of the key, and whether it was found. Later definitions of a key
+// override earlier ones. The empty key is never found.
+func (doc *File) Get(section, key string) (string, bool) {
+	for i := len(doc.lines) - 1; i >= 0; i-- {
+		line := doc.lines[i]
+		if line.defines(section, key) {
+			return line.value(), true
+		}
+	}
+	return "", false
+}
+
+// Sets the key's value. An existing definition is changed where it is;
+// otherwise the key is added to the end of its section, which is added to the
+// end of the file if it doesn't exist yet. The empty key is ignored, as Get
+// would never find it.
+func (doc *File) Set(section, key, value string) {
+	if key == "" {
+		return
+	}
+	for i := len(doc.lines) - 1; i >= 0; i-- {
+		line := &doc.lines[i]
+		if line.defines(section, key) {
+			// Keep the indentation and spacing around the =
+			eq := strings.Index(line.text, "=")
+			prefix := line.text[:eq+1]
+			if strings.HasPrefix(line.text[eq+1:], " ") {
+				prefix += " "
+			}
+			line.text = prefix + value
+			return
+		}
+	}
+
+	newLine := iniLine{text: key + " = " + value, section: section, key: key}
+	// After the section's last key or header, so comments and blank lines
+	// before the next section stay with it
+	last := -1
+	for i, line := range doc.lines {
+		if line.section == section && (line.key != "" || line.header) {
+			last = i
+		}
+	}
+	if last < 0 && section == "" {
+		// The global section comes before any header
+		doc.insert(0, newLine)
+		return
+	}
+	if last < 0 {
+		if len(doc.lines) > 0 && strings.TrimSpace(doc.lines[len(doc.lines)-1].text) != "" {
+			doc.lines = append(doc.lines, iniLine{section: doc.lines[len(doc.lines)-1].section})
+		}
+		doc.lines = append(doc.lines, iniLine{text: "[" + section + "]", section: section, header: true})
+		doc.lines = append(doc.lines, newLine)
+		return
+	}
+	doc.insert(last+1, newLine)
+}
+
+// The names of the sections with at least one key, in the order they first
+// appear. The global section is included, as "", if it has any keys.
+func (doc *File) Sections() []string {
+	var sections []string
+	seen := make(map[string]bool)
+	for _, line := range doc.lines {
+		if line.key != "" && !seen[line.section] {
+			seen[line.section] = true
+			sections = append(sections, line.section)
+		}
+	}
+	return sections
+}
+
+func (doc *File) insert(i int, line iniLine) {
+	doc.lines = append(doc.lines, iniLine{})
+	copy(doc.lines[i+1:], doc.lines[i:])
+	doc.lines[i] = line
+}
+
+// The file's text, as it would be written back out
+func (doc *File) String() string {
+	var b strings.Builder
+	for _, line := range doc.lines {
+		b.WriteString(line.text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testINI = `# Global options come before any section
+name = danckelmann
+
+[display]
+# Comments are kept
+width = 800
+height=600
+
+[resources]
+packs = base, expansion
+`
+
+func TestParseINIGet(t *testing.T) {
+	doc := ParseINI(testINI)
+	tests := []struct {
+		section, key string
+		value        string
+		ok           bool
+	}{
+		{"", "name", "danckelmann", true},
+		{"display", "width", "800", true},
+		{"display", "height", "600", true},
+		{"resources", "packs", "base, expansion", true},
+		{"display", "packs", "", false},
+		{"missing", "width", "", false},
+		{"display", "# Comments are kept", "", false},
+		// Comments, blank lines and headers have no key
+		{"", "", "", false},
+		{"display", "", "", false},
+	}
+	for _, test := range tests {
+		value, ok := doc.Get(test.section, test.key)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Get(%q, %q) = %q, %v, want %q, %v", test.section, test.key,
+				value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestParseINILaterKeysWin(t *testing.T) {
+	doc := ParseINI("[a]\nx = 1\n[b]\nx = 2\n[a]\nx = 3\n")
+	if value, _ := doc.Get("a", "x"); value != "3" {
+		t.Errorf("Get(a, x) = %q, want 3", value)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(doc.Sections(), want) {
+		t.Errorf("Sections() = %q, want %q", doc.Sections(), want)
+	}
+}
+
+func TestINISections(t *testing.T) {
+	doc := ParseINI(testINI)
+	want := []string{"", "display", "resources"}
+	if got := doc.Sections(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sections() = %q, want %q", got, want)
+	}
+
+	// Sections without keys aren't listed
+	doc = ParseINI("[empty]\n# nothing here\n[full]\nx = 1\n")
+	want = []string{"full"}
+	if got := doc.Sections(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sections() = %q, want %q", got, want)
+	}
+}
+
+func TestINIRoundTrip(t *testing.T) {
+	if got := ParseINI(testINI).String(); got != testINI {
+		t.Errorf("String() changed the file:\n%s\nwant:\n%s", got, testINI)
+	}
+	// Windows line endings are read, and written back as \n
+	if got := ParseINI("[a]\r\nx = 1\r\n").String(); got != "[a]\nx = 1\n" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestINISet(t *testing.T) {
+	doc := ParseINI(testINI)
+	doc.Set("display", "width", "1024")
+	doc.Set("display", "height", "768")
+	doc.Set("display", "vsync", "false")
+	doc.Set("", "debug", "true")
+	doc.Set("audio", "volume", "50")
+
+	want := `# Global options come before any section
+name = danckelmann
+debug = true
+
+[display]
+# Comments are kept
+width = 1024
+height=768
+vsync = false
+
+[resources]
+packs = base, expansion
+
+[audio]
+volume = 50
+`
+	if got := doc.String(); got != want {
+		t.Errorf("after Set:\n%s\nwant:\n%s", got, want)
+	}
+
+	// What was set can be read back, including after writing it out
+	for _, doc := range []*File{doc, ParseINI(doc.String())} {
+		for _, kv := range [][3]string{
+			{"display", "width", "1024"},
+			{"display", "vsync", "false"},
+			{"", "debug", "true"},
+			{"audio", "volume", "50"},
+		} {
+			if value, ok := doc.Get(kv[0], kv[1]); !ok || value != kv[2] {
+				t.Errorf("Get(%q, %q) = %q, %v, want %q", kv[0], kv[1], value, ok, kv[2])
+			}
+		}
+	}
+}
+
+func TestINISetEmpty(t *testing.T) {
+	doc := ParseINI("")
+	doc.Set("a", "x", "1")
+	doc.Set("", "y", "2")
+	if got, want := doc.String(), "y = 2\n[a]\nx = 1\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestINISetEmptyKey(t *testing.T) {
+	doc := ParseINI("[a]\n# Comment\n\n= orphan\n")
+	doc.Set("a", "", "1")
+	if got, want := doc.String(), "[a]\n# Comment\n\n= orphan\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
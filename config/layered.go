@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Where an option's value came from. Later layers override earlier ones.
+type Layer int
+
+const (
+	LAYER_DEFAULT Layer = iota
+	LAYER_SYSTEM
+	LAYER_USER
+	LAYER_ENV
+	LAYER_FLAGS
+)
+
+func (l Layer) String() string {
+	switch l {
+	case LAYER_DEFAULT:
+		return "default"
+	case LAYER_SYSTEM:
+		return "system file"
+	case LAYER_USER:
+		return "user file"
+	case LAYER_ENV:
+		return "environment"
+	case LAYER_FLAGS:
+		return "command line"
+	}
+	return fmt.Sprintf("Layer(%d)", int(l))
+}
+
+const (
+	// Prefix of environment variables that set options, as
+	// DANCKELMANN_SECTION_KEY
+	DEFAULT_ENV_PREFIX = "DANCKELMANN"
+	// The system-wide config LoadUserConfig reads beneath the user's. Use a
+	// Loader to read one from elsewhere.
+	SYSTEM_CONFIG_LOCATION = "/etc/danckelmann/config.ini"
+)
+
+// Options given with -set section.key=value. Register with flag.Var, and
+// pass to Loader.
+type Overrides []string
+
+func (o *Overrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *Overrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%q is not section.key=value", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// Builds a config from several layers, each overriding the one before:
+// defaults, the system file, the user file, environment variables, then the
+// command line
+type Loader struct {
+	// Defaults, keyed by section.key. See Defaults.
+	Defaults map[string]string
+	// Config files, either of which may be empty or missing
+	SystemFile, UserFile string
+	// Prefix of the environment variables to read. Defaults to
+	// DEFAULT_ENV_PREFIX.
+	EnvPrefix string
+	Overrides Overrides
+}
+
+// Which layer supplied an option's value, and where in it
+type Provenance struct {
+	Layer Layer
+	// The file, environment variable or flag the value was read from
+	Origin string
+	Value  string
+}
+
+// The merged config, remembering where each value came from
+type LayeredConfig struct {
+	Config  *File
+	sources map[string]Provenance
+}
+
+// The defaults from the struct's default tags, keyed by section.key, for
+// Loader.Defaults
+func Defaults(schema interface{}) map[string]string {
+	defaults := make(map[string]string)
+	walkFields(structValue(schema, "Defaults"), func(key string, tag reflect.StructTag, field reflect.Value) {
+		if def, ok := tag.Lookup("default"); ok {
+			defaults[key] = def
+		}
+	})
+	return defaults
+}
+
+// Loads every layer. Missing files are skipped; files that can't be read and
+// malformed environment variables or overrides are returned as errors, with
+// everything else still loaded.
+func (l *Loader) Load() (*LayeredConfig, error) {
+	lc := &LayeredConfig{Config: ParseINI(""), sources: make(map[string]Provenance)}
+	var errs []string
+
+	for key, val := range l.Defaults {
+		lc.set(key, val, Provenance{Layer: LAYER_DEFAULT, Origin: "built in"})
+	}
+
+	for _, file := range []struct {
+		layer Layer
+		name  string
+	}{{LAYER_SYSTEM, l.SystemFile}, {LAYER_USER, l.UserFile}} {
+		if file.name == "" {
+			continue
+		}
+		fname := os.ExpandEnv(file.name)
+		data, err := ioutil.ReadFile(fname)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("could not read %v %q: %v", file.layer, fname, err))
+			continue
+		}
+		doc := ParseINI(string(data))
+		for _, line := range doc.lines {
+			if line.key == "" {
+				continue
+			}
+			lc.set(joinKey(line.section, line.key), line.value(),
+				Provenance{Layer: file.layer, Origin: fname})
+		}
+	}
+
+	prefix := l.EnvPrefix
+	if prefix == "" {
+		prefix = DEFAULT_ENV_PREFIX
+	}
+	prefix += "_"
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		name, val := kv[:i], kv[i+1:]
+		// SECTION_KEY, where the key may contain underscores but the
+		// section may not
+		parts := strings.SplitN(strings.TrimPrefix(name, prefix), "_", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fmt.Sprintf("environment variable %v is not %vSECTION_KEY", name, prefix))
+			continue
+		}
+		key := strings.ToLower(parts[0]) + "." + strings.ToLower(parts[1])
+		lc.set(key, val, Provenance{Layer: LAYER_ENV, Origin: name})
+	}
+
+	for _, override := range l.Overrides {
+		i := strings.Index(override, "=")
+		if i < 0 {
+			errs = append(errs, fmt.Sprintf("-set %q is not section.key=value", override))
+			continue
+		}
+		// Lowercased, as environment variables are, so -set Display.Width
+		// overrides display.width
+		key := strings.ToLower(strings.TrimSpace(override[:i]))
+		if _, name := splitKey(key); name == "" {
+			errs = append(errs, fmt.Sprintf("-set %q has no option name", override))
+			continue
+		}
+		lc.set(key, strings.TrimSpace(override[i+1:]), Provenance{Layer: LAYER_FLAGS, Origin: "-set " + override})
+	}
+
+	if len(errs) > 0 {
+		return lc, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return lc, nil
+}
+
+// Loads every layer and reads the engine's settings from them, defaulting to
+// the UserConfig's own defaults if Defaults is nil. Raw is the
+// *LayeredConfig. The settings are usable even if an error is returned.
+func (l *Loader) LoadUser() (*UserConfig, error) {
+	loader := *l
+	if loader.Defaults == nil {
+		loader.Defaults = Defaults(UserConfig{})
+	}
+	lc, loadErr := loader.Load()
+	user, err := ReadUserConfig(lc)
+	if loadErr != nil {
+		return user, loadErr
+	}
+	return user, err
+}
+
+func (lc *LayeredConfig) set(key, val string, from Provenance) {
+	sec, name := splitKey(key)
+	lc.Config.Set(sec, name, val)
+	from.Value = val
+	lc.sources[key] = from
+}
+
+// Reads the engine's settings from the merged config. See ReadUserConfig.
+func (lc *LayeredConfig) User() (*UserConfig, error) {
+	return ReadUserConfig(lc)
+}
+
+func (lc *LayeredConfig) Get(section, key string) (string, bool) {
+	return lc.Config.Get(section, key)
+}
+
+// Where the option, given as section.key or just key for global options, got
+// its value
+func (lc *LayeredConfig) Source(key string) (Provenance, bool) {
+	from, ok := lc.sources[key]
+	return from, ok
+}
+
+// Every option's value and where it came from, one per line, for support
+// tickets
+func (lc *LayeredConfig) Report() string {
+	keys := make([]string, 0, len(lc.sources))
+	for key := range lc.sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		from := lc.sources[key]
+		fmt.Fprintf(&b, "%s=%q (%v: %s)\n", key, from.Value, from.Layer, from.Origin)
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoaderLayers(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "system.ini")
+	user := filepath.Join(dir, "user.ini")
+	if err := ioutil.WriteFile(system, []byte("name = system\n[display]\nwidth = 800\nheight = 600\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(user, []byte("[display]\nheight = 700\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DANCKELMANN_DISPLAY_VSYNC", "false")
+
+	loader := Loader{
+		Defaults:   map[string]string{"name": "default", "display.width": "640", "display.vsync": "true"},
+		SystemFile: system,
+		UserFile:   user,
+		// Keys are lowercased, as for environment variables
+		Overrides: Overrides{"Display.Width=1024"},
+	}
+	lc, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, value string
+		layer      Layer
+	}{
+		// Global options are keyed without a section, as in Defaults
+		{"name", "system", LAYER_SYSTEM},
+		{"display.width", "1024", LAYER_FLAGS},
+		{"display.height", "700", LAYER_USER},
+		{"display.vsync", "false", LAYER_ENV},
+	}
+	for _, test := range tests {
+		from, ok := lc.Source(test.key)
+		if !ok || from.Value != test.value || from.Layer != test.layer {
+			t.Errorf("Source(%q) = %+v, %v, want %q from the %v", test.key, from, ok,
+				test.value, test.layer)
+		}
+		sec, name := splitKey(test.key)
+		if value, _ := lc.Get(sec, name); value != test.value {
+			t.Errorf("Get(%q, %q) = %q, want %q", sec, name, value, test.value)
+		}
+	}
+	if _, ok := lc.Source(".name"); ok {
+		t.Error(`global option recorded as ".name"`)
+	}
+}
+
+func TestLoadUserConfigLayers(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.ini")
+	if err := ioutil.WriteFile(fname, []byte("[display]\nwidth = 800\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DANCKELMANN_DISPLAY_HEIGHT", "500")
+
+	user, err := LoadUserConfig(fname, "display.vsync=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Display.Width != 800 || user.Display.Height != 500 || user.Display.VSync {
+		t.Errorf("display settings = %+v, want 800x500 from the file and environment, "+
+			"without vsync from the command line", user.Display)
+	}
+	lc, ok := user.Raw.(*LayeredConfig)
+	if !ok {
+		t.Fatalf("Raw is a %T, want a *LayeredConfig", user.Raw)
+	}
+	if from, _ := lc.Source("display.vsync"); from.Layer != LAYER_FLAGS {
+		t.Errorf("display.vsync came from the %v, want the command line", from.Layer)
+	}
+	if from, _ := lc.Source("display.monitor"); from.Layer != LAYER_DEFAULT {
+		t.Errorf("display.monitor came from the %v, want the defaults", from.Layer)
+	}
+
+	// A missing file is no error
+	if _, err := LoadUserConfig(filepath.Join(t.TempDir(), "missing.ini")); err != nil {
+		t.Errorf("LoadUserConfig of a missing file: %v", err)
+	}
+}
+
+func TestLoaderLoadUser(t *testing.T) {
+	system := filepath.Join(t.TempDir(), "system.ini")
+	if err := ioutil.WriteFile(system, []byte("[display]\nwidth = 1024\nsamples = 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := Loader{SystemFile: system, Overrides: Overrides{"display.samples=2"}}
+	user, err := loader.LoadUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Display.Width != 1024 || user.Display.Samples != 2 || user.Display.Height != 400 {
+		t.Errorf("display settings = %+v, want the system width, overridden samples "+
+			"and the default height", user.Display)
+	}
+}
+
+func TestLoaderRejectsBadOverrides(t *testing.T) {
+	loader := Loader{Overrides: Overrides{"display.=1", "nokey"}}
+	lc, err := loader.Load()
+	if err == nil {
+		t.Error("Load with bad overrides succeeded")
+	}
+	if report := lc.Report(); report != "" {
+		t.Errorf("bad overrides recorded:\n%s", report)
+	}
+}
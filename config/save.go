@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The values of the struct's fields tagged with ini, formatted as they would
+// be written to a config file and keyed by section.key. Nested structs are
+// included, as in Fill.
+func Values(src interface{}) map[string]string {
+	values := make(map[string]string)
+	walkFields(structValue(src, "Values"), func(key string, tag reflect.StructTag, field reflect.Value) {
+		if val, ok := formatValue(field); ok {
+			values[key] = val
+		}
+	})
+	return values
+}
+
+// Formats the field's value the way setValue parses it
+func formatValue(v reflect.Value) (string, bool) {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String(), true
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), true
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			items := make([]string, v.Len())
+			for i := range items {
+				items[i] = v.Index(i).String()
+			}
+			return strings.Join(items, ","), true
+		}
+	}
+	return "", false
+}
+
+// Writes the struct's tagged fields to the config file. See SaveValues.
+func Save(configLocation string, src interface{}) error {
+	return SaveValues(configLocation, Values(src))
+}
+
+// Writes the settings that have been changed since they were read from Raw,
+// or since the last Save, to the config file. Settings left alone aren't
+// written, so ones that were never set keep following the engine's defaults.
+// See SaveValues.
+func (user *UserConfig) Save(configLocation string) error {
+	before := user.saved
+	if before == nil {
+		raw := user.Raw
+		if raw == nil {
+			raw = ParseINI("")
+		}
+		loaded, _ := ReadUserConfig(raw)
+		before = Values(loaded)
+	}
+	after := Values(user)
+	changed := make(map[string]string)
+	for key, val := range after {
+		if before[key] != val {
+			changed[key] = val
+		}
+	}
+	if err := SaveValues(configLocation, changed); err != nil {
+		return err
+	}
+	user.saved = after
+	return nil
+}
+
+// Sets the options, keyed by section.key, in the config file. Everything else
+// in the file, comments included, is kept as it was, and existing options
+// stay where they are. The file and its directory are created if missing.
+//
+// The file is replaced atomically, so it is never left half written: the new
+// contents are written to a temporary file next to it, which is then renamed
+// over it. Nothing is written if a key or value contains a line break, which
+// would let it add options of its own, or if a key has no name.
+func SaveValues(configLocation string, values map[string]string) error {
+	for key, val := range values {
+		if strings.ContainsAny(key+val, "\r\n") {
+			return fmt.Errorf("could not save %s=%q: options can't contain line breaks", key, val)
+		}
+		if _, name := splitKey(key); name == "" {
+			return fmt.Errorf("could not save %s=%q: options need a name", key, val)
+		}
+	}
+
+	fname := os.ExpandEnv(configLocation)
+	dir := filepath.Dir(fname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create config directory: %w", err)
+	}
+
+	var doc *File
+	perm := os.FileMode(0644)
+	data, err := ioutil.ReadFile(fname)
+	switch {
+	case err == nil:
+		doc = ParseINI(string(data))
+		if info, err := os.Stat(fname); err == nil {
+			perm = info.Mode().Perm()
+		}
+	case os.IsNotExist(err):
+		doc = ParseINI("")
+	default:
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	// Sorted, so that new options are added in a predictable order
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sec, name := splitKey(key)
+		doc.Set(sec, name, values[key])
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(fname)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary config file: %w", err)
+	}
+	_, err = tmp.WriteString(doc.String())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write config file %q: %w", fname, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserConfigSaveOnlyChanged(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.ini")
+	if err := ioutil.WriteFile(fname, []byte("[display]\n# Mine\nwidth = 800\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	user, err := LoadUserConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Display.VSync = false
+	if err := user.Save(fname); err != nil {
+		t.Fatal(err)
+	}
+
+	// The width was already there and vsync was changed; the defaults of
+	// everything else are left out
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[display]\n# Mine\nwidth = 800\nvsync = false\n"
+	if string(data) != want {
+		t.Errorf("saved:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Settings made without a file start from the defaults
+	fname = filepath.Join(t.TempDir(), "new.ini")
+	user, _ = ReadUserConfig(ParseINI(""))
+	user.Display.Width = 1024
+	user.Raw = nil
+	if err := user.Save(fname); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(fname); string(data) != "[display]\nwidth = 1024\n" {
+		t.Errorf("saved %q, want just the width", data)
+	}
+}
+
+func TestUserConfigSaveRevert(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.ini")
+	if err := ioutil.WriteFile(fname, []byte("[display]\nwidth = 800\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	user, err := LoadUserConfig(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed, then changed back, within one session
+	for _, width := range []int{1024, 800} {
+		user.Display.Width = width
+		if err := user.Save(fname); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := LoadUserConfig(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Display.Width != width {
+			t.Errorf("saved width %v, want %v", saved.Display.Width, width)
+		}
+	}
+}
+
+func TestSaveValuesRejectsBadOptions(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "config.ini")
+	for _, values := range []map[string]string{
+		{"display.title": "a\n[resources]\npacks = evil"},
+		{"display.title": "a\rb"},
+		{"display.a\nb": "c"},
+		{"display.": "a"},
+		{"": "a"},
+	} {
+		if err := SaveValues(fname, values); err == nil {
+			t.Errorf("SaveValues(%q) succeeded", values)
+		}
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("config file written despite the errors: %v", err)
+	}
+}
+
+func TestSaveValuesWrapsErrors(t *testing.T) {
+	// A file where the directory should be
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := SaveValues(filepath.Join(parent, "config.ini"), map[string]string{"a.b": "c"})
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Errorf("SaveValues error %v doesn't wrap the *os.PathError", err)
+	}
+}
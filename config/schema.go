@@ -0,0 +1,223 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A config value that was missing, unparseable or out of range
+type FieldError struct {
+	// The option, as section.key
+	Key   string
+	Value string
+	// What was wrong with it
+	Problem string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s=%q %s", e.Key, e.Value, e.Problem)
+}
+
+// Every problem found while filling a struct
+type Errors []*FieldError
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Fills the struct dst points to from the config, following the fields' tags:
+//
+//	ini:"section.key"    the option the field is read from
+//	default:"value"      used when the option is missing or invalid
+//	min:"n" max:"n"      the range of numeric options, in seconds for
+//	                     durations
+//	enum:"a,b,c"         the values a string option may take
+//
+// Fields may be strings, ints, bools, floats, time.Durations or string slices,
+// which are comma separated lists. Fields without an ini tag are left alone,
+// apart from nested structs, which are filled in turn. Fields without a
+// default tag keep their value when the option is missing. Every invalid
+// option is reported in the returned Errors, and its field is set to the
+// default, so dst is always usable.
+func Fill(conf Source, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("config.Fill needs a pointer to a struct, not %T", dst))
+	}
+	var errs Errors
+	walkFields(v.Elem(), func(key string, tag reflect.StructTag, field reflect.Value) {
+		fillField(conf, key, tag, field, &errs)
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Calls fn for every field tagged with ini, descending into nested structs
+// that aren't tagged
+func walkFields(v reflect.Value, fn func(key string, tag reflect.StructTag, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		key, ok := field.Tag.Lookup("ini")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				walkFields(v.Field(i), fn)
+			}
+			continue
+		}
+		fn(key, field.Tag, v.Field(i))
+	}
+}
+
+// The struct that src is, or points to
+func structValue(src interface{}, caller string) reflect.Value {
+	v := reflect.ValueOf(src)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("config.%s needs a struct, not %T", caller, src))
+	}
+	return v
+}
+
+func fillField(conf Source, key string, tag reflect.StructTag, v reflect.Value, errs *Errors) {
+	sec, name := splitKey(key)
+	def, hasDef := tag.Lookup("default")
+	setDefault := func() {
+		if !hasDef {
+			return
+		}
+		if problem := setValue(v, def, tag); problem != "" {
+			*errs = append(*errs, &FieldError{key, def, "is a bad default: " + problem})
+		}
+	}
+
+	val, ok := conf.Get(sec, name)
+	if !ok {
+		setDefault()
+		return
+	}
+	if problem := setValue(v, val, tag); problem != "" {
+		*errs = append(*errs, &FieldError{key, val, problem})
+		setDefault()
+	}
+}
+
+// Splits section.key at the first dot. Keys without a dot are in the global
+// section.
+func splitKey(key string) (string, string) {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// The inverse of splitKey
+func joinKey(section, key string) string {
+	if section == "" {
+		return key
+	}
+	return section + "." + key
+}
+
+// Parses the value into the field, checking it against the tag's range and
+// enum. Returns what was wrong with it, or "" if nothing was.
+func setValue(v reflect.Value, val string, tag reflect.StructTag) string {
+	// Durations are int64s, so have to be caught before their kind is
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil {
+			return "not parseable as duration"
+		}
+		if problem := checkRange(d.Seconds(), tag); problem != "" {
+			return problem
+		}
+		v.SetInt(int64(d))
+		return ""
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if enum, ok := tag.Lookup("enum"); ok {
+			allowed := strings.Split(enum, ",")
+			found := false
+			for _, a := range allowed {
+				if val == a {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Sprintf("not one of %q", allowed)
+			}
+		}
+		v.SetString(val)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(val), 10, v.Type().Bits())
+		if err != nil {
+			return "not parseable as integer"
+		}
+		if problem := checkRange(float64(n), tag); problem != "" {
+			return problem
+		}
+		v.SetInt(n)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(val))
+		if err != nil {
+			return "not parseable as boolean"
+		}
+		v.SetBool(b)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(val), v.Type().Bits())
+		if err != nil {
+			return "not parseable as float"
+		}
+		if problem := checkRange(f, tag); problem != "" {
+			return problem
+		}
+		v.SetFloat(f)
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Sprintf("is for a field of unsupported type %v", v.Type())
+		}
+		v.Set(reflect.ValueOf(parseStringList(val)).Convert(v.Type()))
+
+	default:
+		return fmt.Sprintf("is for a field of unsupported type %v", v.Type())
+	}
+	return ""
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Checks the number against the tag's min and max, if it has them
+func checkRange(n float64, tag reflect.StructTag) string {
+	if min, ok := tag.Lookup("min"); ok {
+		if m, err := strconv.ParseFloat(min, 64); err == nil && n < m {
+			return "less than the minimum of " + min
+		}
+	}
+	if max, ok := tag.Lookup("max"); ok {
+		if m, err := strconv.ParseFloat(max, 64); err == nil && n > m {
+			return "more than the maximum of " + max
+		}
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package display
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Ticks per second if DisplayConfig.TickRate is not set
+	DEFAULT_TICK_RATE = 20
+	// The most ticks run between two frames. If the game can't keep up, it
+	// slows down rather than spending ever longer catching up.
+	MAX_TICKS_PER_FRAME = 5
+
+	MIN_GAME_SPEED = 0.5
+	MAX_GAME_SPEED = 4.0
+)
+
+// Optionally implemented by a GameEngine to have the display engine run its
+// simulation. Update is called at a fixed rate, DisplayConfig.TickRate times
+// per second of game time, from the same goroutine as Run. Entities are
+// committed after each tick, so the game should not call CommitTick itself.
+type Updater interface {
+	Update(dt time.Duration)
+}
+
+// Runs an Updater at a fixed tick rate, however fast frames are drawn
+type gameClock struct {
+	lock   sync.Mutex
+	tick   time.Duration
+	speed  float64
+	paused bool
+	// Ticks requested by Step while paused
+	steps int
+
+	last time.Time
+	// Game time not yet simulated
+	accumulator time.Duration
+}
+
+func createGameClock(tickRate int) *gameClock {
+	if tickRate <= 0 {
+		tickRate = DEFAULT_TICK_RATE
+	}
+	return &gameClock{tick: time.Second / time.Duration(tickRate), speed: 1}
+}
+
+// Returns how many ticks to run for the time passed since the last call
+func (c *gameClock) advance(now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elapsed := now.Sub(c.last)
+	if c.last.IsZero() {
+		elapsed = 0
+	}
+	c.last = now
+
+	if c.paused {
+		steps := c.steps
+		c.steps = 0
+		return steps
+	}
+
+	c.accumulator += time.Duration(float64(elapsed) * c.speed)
+	ticks := int(c.accumulator / c.tick)
+	if ticks > MAX_TICKS_PER_FRAME {
+		ticks = MAX_TICKS_PER_FRAME
+		c.accumulator = c.tick * MAX_TICKS_PER_FRAME
+	}
+	c.accumulator -= time.Duration(ticks) * c.tick
+	return ticks
+}
+
+// How far the game is between its last tick and the next, from 0 to 1
+func (c *gameClock) alpha() float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		return 1
+	}
+	return float64(c.accumulator) / float64(c.tick)
+}
+
+// Runs the GameEngine's ticks that are due, if it is an Updater
+func (d *DisplayEngine) runTicks() {
+	updater, ok := (*d.gameEngine).(Updater)
+	if !ok {
+		return
+	}
+	for n := d.clock.advance(time.Now()); n > 0; n-- {
+		updater.Update(d.clock.tick)
+		d.CommitTick()
+	}
+}
+
+// How far the game is between its last tick and the next, from 0 to 1. Use it
+// to interpolate anything the GameEngine animates itself.
+func (d *DisplayEngine) GetInterpolationAlpha() float64 {
+	if _, ok := (*d.gameEngine).(Updater); ok {
+		return d.clock.alpha()
+	}
+	d.entities.lock.Lock()
+	defer d.entities.lock.Unlock()
+	return d.entities.alpha()
+}
+
+// Stops or restarts the game's ticks. Drawing carries on while paused.
+func (d *DisplayEngine) SetPaused(paused bool) {
+	d.clock.lock.Lock()
+	d.clock.paused = paused
+	d.clock.steps = 0
+	d.clock.accumulator = 0
+	d.clock.lock.Unlock()
+}
+
+func (d *DisplayEngine) IsPaused() bool {
+	d.clock.lock.Lock()
+	defer d.clock.lock.Unlock()
+	return d.clock.paused
+}
+
+// Runs a single tick while paused
+func (d *DisplayEngine) Step() {
+	d.clock.lock.Lock()
+	if d.clock.paused {
+		d.clock.steps++
+	}
+	d.clock.lock.Unlock()
+}
+
+// Sets how many times faster than normal the game runs, from MIN_GAME_SPEED
+// to MAX_GAME_SPEED. Speeds that aren't finite are ignored.
+func (d *DisplayEngine) SetGameSpeed(speed float64) {
+	if math.IsNaN(speed) || math.IsInf(speed, 0) {
+		log.Printf("Game speed %v not a number, ignoring", speed)
+		return
+	}
+	if speed < MIN_GAME_SPEED || speed > MAX_GAME_SPEED {
+		log.Printf("Game speed %v not between %v and %v, clamping", speed,
+			MIN_GAME_SPEED, MAX_GAME_SPEED)
+		if speed < MIN_GAME_SPEED {
+			speed = MIN_GAME_SPEED
+		} else {
+			speed = MAX_GAME_SPEED
+		}
+	}
+	d.clock.lock.Lock()
+	d.clock.speed = speed
+	d.clock.lock.Unlock()
+}
+
+func (d *DisplayEngine) GetGameSpeed() float64 {
+	d.clock.lock.Lock()
+	defer d.clock.lock.Unlock()
+	return d.clock.speed
+}
@@ -0,0 +1,28 @@
+package display
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetGameSpeed(t *testing.T) {
+	d := &DisplayEngine{clock: createGameClock(0)}
+	tests := []struct {
+		speed, want float64
+	}{
+		{2, 2},
+		{100, MAX_GAME_SPEED},
+		{0, MIN_GAME_SPEED},
+		{3, 3},
+		// Not finite, so the speed is left as it was
+		{math.NaN(), 3},
+		{math.Inf(1), 3},
+		{math.Inf(-1), 3},
+	}
+	for _, test := range tests {
+		d.SetGameSpeed(test.speed)
+		if got := d.GetGameSpeed(); got != test.want {
+			t.Errorf("after SetGameSpeed(%v), speed = %v, want %v", test.speed, got, test.want)
+		}
+	}
+}
@@ -13,4 +13,23 @@ type DisplayConfig struct {
 	TileW, TileH int
 	// The color of the "void" (i.e. where no tiles are drawn)
 	BGColor allegro.Color
+	// How many pixels a tile is lifted per unit of height. MaxHeight is the
+	// largest height Heights returns, which bounds the search when picking
+	// tiles.
+	HeightStep, MaxHeight int
+	// The heights of the tiles. Defaults to the game engine, if it
+	// implements HeightMapper; if neither, the map is flat.
+	Heights HeightMapper
+	// How tiles are laid out on the screen. Defaults to PROJECTION_DIAMOND.
+	Projection ProjectionType
+	// If not nil, used instead of the projection selected by Projection
+	CustomProjection Projection
+	// Built once by the display engine from the fields above
+	projection Projection
+	// The names of the layers items are drawn in, bottom first. Defaults to
+	// DEFAULT_LAYERS.
+	Layers []string
+	// Ticks per second of game time, if the game engine implements Updater.
+	// Defaults to DEFAULT_TICK_RATE.
+	TickRate int
 }
@@ -0,0 +1,141 @@
+package display
+
+import (
+	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+
+	"github.com/bluepeppers/danckelmann/resources"
+)
+
+// How a bitmap is combined with what has already been drawn
+type BlendMode int
+
+const (
+	// Normal alpha blending
+	BLEND_ALPHA BlendMode = iota
+	// Adds to what is beneath, e.g. for fire, magic or lights
+	BLEND_ADDITIVE
+	// Multiplies what is beneath, e.g. for shadows or night
+	BLEND_MULTIPLY
+)
+
+type FlipFlags int
+
+const (
+	FLIP_HORIZONTAL FlipFlags = 1 << iota
+	FLIP_VERTICAL
+)
+
+// A bitmap to draw on a tile, and how to draw it. Apart from the bitmap, the
+// zero value draws it as it is: untinted, opaque, alpha blended and unflipped.
+// Items without a bitmap are skipped.
+type DrawItem struct {
+	Bitmap *resources.Bitmap
+	// Multiplied with the bitmap's colours, alpha included. The zero colour
+	// leaves them as they are.
+	Tint allegro.Color
+	// From 0 (invisible) to 1 (opaque), multiplied with the tint's alpha,
+	// except that 0 is taken as 1 so the zero value is opaque. To hide an
+	// item, leave it out.
+	Opacity float32
+	Blend   BlendMode
+	Flip    FlipFlags
+	// The name of the layer to draw the item in, from DisplayConfig.Layers.
+	// Leave empty to use the item's position in the tile's stack.
+	Layer string
+}
+
+// An untinted, opaque, alpha blended and unflipped item
+func NewDrawItem(bmp *resources.Bitmap) DrawItem {
+	return DrawItem{
+		Bitmap:  bmp,
+		Tint:    allegro.CreateColor(255, 255, 255, 255),
+		Opacity: 1,
+	}
+}
+
+// Wraps each bitmap with NewDrawItem
+func DrawItems(bmps ...*resources.Bitmap) []DrawItem {
+	items := make([]DrawItem, len(bmps))
+	for i, bmp := range bmps {
+		items[i] = NewDrawItem(bmp)
+	}
+	return items
+}
+
+// The area the item covers when drawn at (px, py), once its bitmap's offset
+// is taken into account
+func (item DrawItem) area(px, py int) (int, int, int, int) {
+	ox, oy := item.Bitmap.Offset()
+	bw, bh := item.Bitmap.Size()
+	return px - ox, py - oy, bw, bh
+}
+
+// Sets the colour premultiplied by its alpha, to match the tile textures and
+// setBlendMode
+func setGLColor(color allegro.Color) {
+	r, g, b, a := color.GetRGBA()
+	alpha := float32(a) / 255
+	gl.Color4f(float32(r)/255*alpha, float32(g)/255*alpha, float32(b)/255*alpha, alpha)
+}
+
+// Tile textures are premultiplied, as image.RGBA is, and so are the colours
+// they are tinted with, so src is c*a throughout
+func setBlendMode(mode BlendMode) {
+	switch mode {
+	case BLEND_ADDITIVE:
+		gl.BlendFunc(gl.ONE, gl.ONE)
+	case BLEND_MULTIPLY:
+		// dst*src + dst*(1-a), which is dst*lerp(1, c, a): transparent
+		// texels leave what is beneath alone rather than brightening it.
+		gl.BlendFunc(gl.DST_COLOR, gl.ONE_MINUS_SRC_ALPHA)
+	default:
+		gl.BlendFunc(gl.ONE, gl.ONE_MINUS_SRC_ALPHA)
+	}
+}
+
+// Draws the item with its top left, less its bitmap's offset, at (px, py) in
+// map pixel coordinates, then
+// restores the default colour and blend mode. Must be called on the render
+// thread.
+func (item DrawItem) draw(px, py int) {
+	if item.Bitmap == nil {
+		return
+	}
+	r, g, b, a := item.Tint.GetRGBA()
+	if r == 0 && g == 0 && b == 0 && a == 0 {
+		r, g, b, a = 255, 255, 255, 255
+	}
+	opacity := item.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+	// Premultiplied, so that fading the item out fades its effect out in
+	// every blend mode
+	alpha := float32(a) / 255 * opacity
+	gl.Color4f(float32(r)/255*alpha, float32(g)/255*alpha,
+		float32(b)/255*alpha, alpha)
+	setBlendMode(item.Blend)
+
+	u0, u1 := float32(0), float32(1)
+	if item.Flip&FLIP_HORIZONTAL != 0 {
+		u0, u1 = u1, u0
+	}
+	v0, v1 := float32(0), float32(1)
+	if item.Flip&FLIP_VERTICAL != 0 {
+		v0, v1 = v1, v0
+	}
+
+	bmp := item.Bitmap
+	px, py, bw, bh := item.area(px, py)
+	bmp.Texture().Bind(gl.TEXTURE_2D)
+	gl.Begin(gl.QUADS)
+	gl.TexCoord2f(u0, v0); gl.Vertex3i(px, py, 0)
+	gl.TexCoord2f(u0, v1); gl.Vertex3i(px, py+bh, 0)
+	gl.TexCoord2f(u1, v1); gl.Vertex3i(px+bw, py+bh, 0)
+	gl.TexCoord2f(u1, v0); gl.Vertex3i(px+bw, py, 0)
+	gl.End()
+
+	gl.Color4f(1, 1, 1, 1)
+	setBlendMode(BLEND_ALPHA)
+}
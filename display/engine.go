@@ -1,7 +1,10 @@
 package display
 
 import (
+	"errors"
 	"log"
+	"os"
+	"strings"
 	"sync"
 	"time"
 	"fmt"
@@ -17,6 +20,9 @@ const (
 	// Default dimensions of the display. Often not used
 	DEFAULT_WIDTH  = 600
 	DEFAULT_HEIGHT = 400
+
+	// The maximum number of tiles to upload to the GPU each frame
+	TILE_UPLOADS_PER_FRAME = 8
 )
 
 // The interface that a game engine must implement for the display engine to
@@ -26,21 +32,30 @@ type GameEngine interface {
 	// once at engine startup.
 	GetDisplayConfig() DisplayConfig
 
-	// For best results, make sure that the bitmaps all share a common
-	// parent. This is done automatically if they are loaded via a
-	// resouces.ResourceManager
-	GetTile(int, int) []*resources.Bitmap
+	// Returns what to draw on the tile. Items are drawn in their layers,
+	// and in the order returned within a layer. For best results, make
+	// sure that the bitmaps all share a common parent. This is done
+	// automatically if they are loaded via a resouces.ResourceManager
+	GetTile(int, int) []DrawItem
 
 	// Passes a fully initialized DisplayEngine to the GameEngine. This
 	// allows the GameEngine to inform the DisplayEngine of changes of state
 	// without the DisplayEngine having to explicitly poll for them.
 	RegisterDisplayEngine(*DisplayEngine)
 
-	// Called when the display receivs a DisplayCloseEvent or the game is
-	// otherwise terminated
+	// Called once when the display engine shuts down, either because the
+	// display was closed or Stop was called. No more frames are drawn and
+	// no more ticks are run after it is called.
 	GameFinished()
 }
 
+// Optionally implemented by a GameEngine for maps with hills, raised plazas
+// and the like. Everything drawn on a tile is lifted by its height times
+// DisplayConfig.HeightStep.
+type HeightMapper interface {
+	GetHeight(x, y int) int
+}
+
 func InitializeAllegro() {
 	allegro.Init()
 	allegro.InitFont()
@@ -56,6 +71,17 @@ type DisplayEngine struct {
 
 	statusLock sync.RWMutex
 	running    bool
+	// Whether Run has been called, and whether a stop has been requested
+	started, stopping bool
+
+	// Closed when a stop is requested, to wake the event handler
+	quit     chan struct{}
+	stopOnce sync.Once
+	// The event handler and frames being drawn, joined on shutdown
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+	// Closed once everything has been torn down
+	closed chan struct{}
 
 	drawLock     sync.RWMutex
 	frameDrawing sync.RWMutex // Locked -> Frame drawing atm
@@ -63,71 +89,225 @@ type DisplayEngine struct {
 	viewport     Viewport
 	Display      *allegro.Display
 	fps          float64
-	cursorX, cursorY float64    
+
+	// Where the mouse was last seen, written by the event handler
+	cursorLock       sync.Mutex
+	cursorX, cursorY float64
 
 	resourceManager *resources.ResourceManager
+
+	textLock     sync.Mutex
+	labels       []*Label
+	missingFonts map[string]bool
+	builtinFont  *allegro.Font
+
+	uiLock sync.Mutex
+	uiFunc UIFunc
+	ui     *UI
+
+	minimap  minimap
+	overlays *overlays
+	layers   *layers
+	entities *entities
+	clock    *gameClock
+	mode     modeState
+
+	// The event handler, frame drawing and teardown of the display and
+	// resources, which tests replace as they have no display
+	listen   func()
+	frame    func(alpha float64)
+	teardown func()
+}
+
+var (
+	// Returned, wrapped, when allegro can't create the display
+	ErrCreateDisplay = errors.New("could not create display")
+	// Returned, wrapped in a ResourceConfigError, when the resource config
+	// can't be loaded
+	ErrResourceConfig = errors.New("could not load resource config")
+)
+
+// The resource config could not be loaded. Diagnostics has every problem
+// found, including those that weren't fatal.
+type ResourceConfigError struct {
+	Roots       []string
+	Diagnostics []resources.Diagnostic
 }
 
-func CreateDisplayEngine(resourceDir string, conf *allegro.Config, gameEngine GameEngine) *DisplayEngine {
+func (e *ResourceConfigError) Error() string {
+	return fmt.Sprintf("%v from %q (%v problems)", ErrResourceConfig, e.Roots,
+		len(e.Diagnostics))
+}
+
+func (e *ResourceConfigError) Unwrap() error {
+	return ErrResourceConfig
+}
+
+// Creates the display and loads the resources. The errors returned wrap
+// ErrCreateDisplay, or are a *ResourceConfigError; nothing is left open if
+// either fails. The settings are read from conf, which may be a config.File, a
+// config.LayeredConfig or allegro's config.
+func CreateDisplayEngine(resourceDir string, conf config.Source, gameEngine GameEngine) (*DisplayEngine, error) {
 	var displayEngine DisplayEngine
 
+	settings, err := config.ReadUserConfig(conf)
+	if errs, ok := err.(config.Errors); ok {
+		layered, _ := conf.(*config.LayeredConfig)
+		for _, err := range errs {
+			if layered != nil {
+				if from, ok := layered.Source(err.Key); ok {
+					log.Printf("Invalid config option from the %v (%s), using the default: %v",
+						from.Layer, from.Origin, err)
+					continue
+				}
+			}
+			log.Printf("Invalid config option, using the default: %v", err)
+		}
+	}
+
 	var wg sync.WaitGroup
+	var dispErr, resErr error
+	mode := readDisplayMode(settings.Display)
 	wg.Add(2)
 	go func() {
-		displayEngine.Display = createDisp(conf)
+		displayEngine.Display, dispErr = createDisp(mode)
 		wg.Done()
 	}()
 	go func() {
-		conf, ok := resources.LoadResourceManagerConfig(resourceDir, "")
+		strict := settings.Resources.Strict
+		roots := append([]string{resourceDir}, resourcePacks(settings.Resources.Packs)...)
+		conf, diags, ok := resources.LoadResourcePacks(roots, strict)
+		for _, diag := range diags {
+			log.Print(diag)
+		}
 		if !ok {
-			log.Fatalf("Could not load resource manager config from %q", resourceDir)
+			resErr = &ResourceConfigError{Roots: roots, Diagnostics: diags}
+		} else {
+			displayEngine.resourceManager = resources.CreateResourceManager(conf)
 		}
-		displayEngine.resourceManager = resources.CreateResourceManager(conf)
 		wg.Done()
 	}()
 	wg.Wait()
 
+	if dispErr != nil || resErr != nil {
+		if displayEngine.resourceManager != nil {
+			displayEngine.resourceManager.Close()
+		}
+		if displayEngine.Display != nil {
+			displayEngine.Display.Destroy()
+		}
+		if dispErr != nil {
+			return nil, dispErr
+		}
+		return nil, resErr
+	}
+
+	budget := settings.Resources.TextureBudgetMB
+	displayEngine.resourceManager.SetTextureBudget(int64(budget) << 20)
+
 	displayEngine.running = false
+	displayEngine.quit = make(chan struct{})
+	displayEngine.mode.current = mode
+	displayEngine.mode.swap = make(chan displaySwap)
+	displayEngine.closed = make(chan struct{})
+	displayEngine.builtinFont = allegro.CreateBuiltinFont()
+	displayEngine.missingFonts = make(map[string]bool)
+	displayEngine.ui = createUI(&displayEngine)
+	displayEngine.overlays = createOverlays()
+	displayEngine.entities = createEntities()
+	displayEngine.listen = displayEngine.eventHandler
+	displayEngine.frame = displayEngine.drawFrame
+	displayEngine.teardown = displayEngine.destroy
 
 	w, h := displayEngine.Display.GetDimensions()
 	displayEngine.viewport = CreateViewport(-w/2, -h/w, w, h, 1.0, 1.0)
 
 	displayEngine.gameEngine = &gameEngine
 	displayEngine.config = (*displayEngine.gameEngine).GetDisplayConfig()
+	if displayEngine.config.Heights == nil {
+		displayEngine.config.Heights, _ = gameEngine.(HeightMapper)
+	}
+	displayEngine.config.projection = displayEngine.config.GetProjection()
+	displayEngine.layers = createLayers(displayEngine.config.Layers)
+	displayEngine.clock = createGameClock(displayEngine.config.TickRate)
 	(*displayEngine.gameEngine).RegisterDisplayEngine(&displayEngine)
 
-	return &displayEngine
-}
-
-func createDisp(conf *allegro.Config) *allegro.Display {
-	/*	width := config.GetInt(conf, "display", "width", DEFAULT_WIDTH)
-		height := config.GetInt(conf, "display", "height", DEFAULT_HEIGHT)*/
-
-	flags := allegro.RESIZABLE
-	switch config.GetString(conf, "display", "windowed", "fullscreenwindow") {
-	case "fullscreen":
-		flags |= allegro.FULLSCREEN
-	case "windowed":
-		flags |= allegro.WINDOWED
-	default:
-		log.Printf("display.windowed not one of \"fullscreen\", \"fullscreenwindow\", or \"windowed\"")
-		log.Printf("Defaulting to display.windowed=\"fullscreenwindow\"")
-		fallthrough
-	case "fullscreenwindow":
-		flags |= allegro.FULLSCREEN_WINDOW
-	}
+	return &displayEngine, nil
+}
 
-	disp := allegro.CreateDisplay(1, 1, flags)
-	if disp == nil {
-		log.Fatalf("Could not create display")
+// The extra resource pack roots to overlay on the base resources, in order,
+// from the comma separated resources.packs option
+func resourcePacks(option string) []string {
+	var packs []string
+	for _, pack := range strings.Split(option, ",") {
+		pack = strings.TrimSpace(pack)
+		if pack != "" {
+			packs = append(packs, os.ExpandEnv(pack))
+		}
 	}
-	return disp
+	return packs
 }
 
+// Asks Run to return after the current frame. Doesn't wait for it to, so is
+// safe to call from GameEngine methods; use Wait for that.
 func (d *DisplayEngine) Stop() {
 	d.statusLock.Lock()
+	d.stop()
+	d.statusLock.Unlock()
+}
+
+// Must be called with statusLock held
+func (d *DisplayEngine) stop() {
 	d.running = false
+	d.stopping = true
+	d.stopOnce.Do(func() { close(d.quit) })
+}
+
+// Waits for the engine to shut down once Run returns: the event handler and
+// the last frame are finished, GameEngine.GameFinished is called, and the
+// resources and display are destroyed. If Run was never called, the engine is
+// shut down straight away. Must not be called from GameEngine methods, as Run
+// can't return until they do.
+func (d *DisplayEngine) Wait() {
+	d.statusLock.Lock()
+	started := d.started
+	if !started {
+		// Stop Run from starting after all
+		d.stop()
+	}
 	d.statusLock.Unlock()
+
+	if started {
+		<-d.closed
+	} else {
+		d.shutdown()
+	}
+}
+
+// Tears everything down once the event handler and frames have finished. Safe
+// to call more than once.
+func (d *DisplayEngine) shutdown() {
+	d.closeOnce.Do(func() {
+		d.workers.Wait()
+		(*d.gameEngine).GameFinished()
+		d.teardown()
+		close(d.closed)
+	})
+}
+
+// Frees the resources, textures and display
+func (d *DisplayEngine) destroy() {
+	d.resourceManager.Close()
+	allegro.RunInThread(func() {
+		d.minimap.lock.Lock()
+		if d.minimap.created {
+			d.minimap.tex.Delete()
+			d.minimap.created = false
+		}
+		d.minimap.lock.Unlock()
+		d.builtinFont.Destroy()
+	})
+	d.Display.Destroy()
 }
 
 func (d *DisplayEngine) GetViewport() *Viewport {
@@ -142,24 +322,59 @@ func (d *DisplayEngine) SetViewport(v *Viewport) {
 	d.drawLock.Unlock()
 }
 
+// Where the mouse was last seen, in screen coordinates
+func (d *DisplayEngine) GetCursor() (float64, float64) {
+	d.cursorLock.Lock()
+	defer d.cursorLock.Unlock()
+	return d.cursorX, d.cursorY
+}
+
+// Returns the tile coordinates of the tile drawn at the point on the screen,
+// taking the heights of tiles into account
+func (d *DisplayEngine) ScreenCoordinatesToTile(sx, sy int) (float64, float64) {
+	viewport := d.GetViewport()
+	return viewport.ScreenCoordinatesToTile(sx, sy, d.config)
+}
+
 func (d *DisplayEngine) GetResourceManager() *resources.ResourceManager {
 	return d.resourceManager
 }
 
+// Draws frames and runs ticks until the display is closed or Stop is called,
+// then shuts the engine down
 func (d *DisplayEngine) Run() {
 	running := true
 	d.statusLock.Lock()
+	if d.stopping || d.started {
+		d.statusLock.Unlock()
+		return
+	}
 	d.running = true
+	d.started = true
 	d.statusLock.Unlock()
+	defer d.shutdown()
 
-	go d.eventHandler()
+	d.workers.Add(1)
+	go func() {
+		defer d.workers.Done()
+		d.listen()
+	}()
 
 	start := time.Now()
 	frames := 0
 	
 	for running {
 		d.frameDrawing.Lock()
-		go d.drawFrame()
+		d.applyDisplayModes()
+		// Ticks run between frames, so the game state doesn't change while
+		// it is being drawn
+		d.runTicks()
+		d.workers.Add(1)
+		go func(alpha float64) {
+			defer d.workers.Done()
+			d.frame(alpha)
+			d.frameDrawing.Unlock()
+		}(d.GetInterpolationAlpha())
 		frames++
 		if frames >= 30 {
 			d.fps = float64(frames) / time.Since(start).Seconds()
@@ -173,26 +388,61 @@ func (d *DisplayEngine) Run() {
 	}
 }
 
-func (d *DisplayEngine) drawFrame() {
-	toDraw := make([][]*resources.Bitmap, d.config.MapW*d.config.MapH)
-	drawPasses := 0
+// Draws a frame, with entities alpha of the way between their positions at
+// the last two ticks
+func (d *DisplayEngine) drawFrame(alpha float64) {
+	viewport := d.viewport
+
+	nLayers := len(d.layers.names)
+	// Indexed by layer, then tile
+	toDraw := make([][][]DrawItem, nLayers)
+	for l := range toDraw {
+		toDraw[l] = make([][]DrawItem, d.config.MapW*d.config.MapH)
+	}
+	// Whether any tile has items in the layer
+	used := make([]bool, nLayers)
+	lifts := make([]int, d.config.MapW*d.config.MapH)
+	heights := d.config.Heights
+	projection := d.config.GetProjection()
+	outline := projection.TileOutline()
 	for x := 0; x < d.config.MapW; x++ {
 		for y := 0; y < d.config.MapH; y++ {
-			toDraw[x*d.config.MapW+y] = (*d.gameEngine).GetTile(x, y)
-			length := len(toDraw[x*d.config.MapW+y])
-			if length > drawPasses {
-				drawPasses = length
+			if heights != nil {
+				lifts[x*d.config.MapH+y] = heights.GetHeight(x, y) * d.config.HeightStep
+			}
+			px, py := projection.TileOrigin(rotateTile(x, y, viewport.rotation, d.config))
+			py -= lifts[x*d.config.MapH+y]
+
+			for i, item := range (*d.gameEngine).GetTile(x, y) {
+				if item.Bitmap == nil {
+					continue
+				}
+				l := d.layers.resolve(item, i)
+				toDraw[l][x*d.config.MapH+y] = append(toDraw[l][x*d.config.MapH+y], item)
+				used[l] = true
+
+				// Tiles still loading are loaded nearest the centre first.
+				// Off screen ones are left alone, so that tiles evicted
+				// to stay within budget aren't loaded straight back in.
+				if viewport.OnScreen(item.area(px, py)) && !item.Bitmap.Ready() {
+					d.resourceManager.PrioritizeTile(item.Bitmap,
+						viewport.DistanceFromCentre(px, py))
+				}
 			}
 		}
 	}
 
-	viewport := d.viewport
-	font := allegro.CreateBuiltinFont()
+	sprites := d.placeEntities(viewport, projection, lifts, alpha)
+	overlays := d.snapshotOverlays()
+	visible := d.layers.visible()
+	ghostLayer := d.layers.ghostLayer()
 
 	// Don't want anyone changing the viewport mid frame or any such highjinks
 	d.Display.SetTargetBackbuffer()
 
 	allegro.RunInThread(func() {
+		d.resourceManager.UploadPendingTiles(TILE_UPLOADS_PER_FRAME)
+
 		r, g, b, a := d.config.BGColor.GetRGBA()
 		gl.ClearColor(
 			gl.GLclampf(r)/255.0,
@@ -203,51 +453,75 @@ func (d *DisplayEngine) drawFrame() {
 		gl.Clear(gl.COLOR_BUFFER_BIT)
 
 		viewport.SetupTransform()
+		gl.Enable(gl.BLEND)
+		setBlendMode(BLEND_ALPHA)
+
+		for l := 0; l < nLayers; l++ {
+			// Overlays are drawn even when their layer is hidden
+			ground := l == 0 && (len(overlays.highlights) > 0 || len(overlays.outlines) > 0)
+			ghosts := l == ghostLayer && len(overlays.ghosts) > 0
+			empty := !used[l] && sprites[l] == nil
+			if (!visible[l] || empty) && !ground && !ghosts {
+				continue
+			}
 
-		for p := 0; p < drawPasses; p++ {
-			m := d.config.MapW
-			n := d.config.MapH
-			for s := 0; s < m+n; s++ {
-				for x := 0; x < s; x++ {
-					y := s - x - 1
-					if x >= m || y < 0 || y >= n {
-						continue
+			// Walk the map as seen with the rotation, back to front
+			m, n := viewDimensions(viewport.rotation, d.config)
+			projection.DrawOrder(m, n, func(vx, vy int) {
+				x, y := unrotateTile(vx, vy, viewport.rotation, d.config)
+
+				// Coordinates in terms of pixels
+				px, py := projection.TileOrigin(vx, vy)
+				py -= lifts[x*d.config.MapH+y]
+				tile := TilePos{x, y}
+
+				if visible[l] {
+					for _, item := range toDraw[l][x*d.config.MapH+y] {
+						if viewport.OnScreen(item.area(px, py)) {
+							d.resourceManager.MarkDrawn(item.Bitmap)
+							item.draw(px, py)
+						}
 					}
-					if len(toDraw[x*d.config.MapW+y]) < p {
-						continue
+				}
+				// Ghosts stand in for the tile's buildings
+				if ghosts {
+					overlays.drawGhosts(tile, px, py)
+				}
+				// Entities standing on the tile, in front of its items
+				if visible[l] && sprites[l] != nil {
+					for _, sprite := range sprites[l][x*d.config.MapH+y] {
+						if viewport.OnScreen(sprite.item.area(sprite.px, sprite.py)) {
+							d.resourceManager.MarkDrawn(sprite.item.Bitmap)
+							sprite.item.draw(sprite.px, sprite.py)
+						}
 					}
+				}
 
-					// Coordinates in terms of pixels
-					px := (y-x)*d.config.TileW/2
-					py := (x+y)*d.config.TileH/2
-					bmp := toDraw[x*d.config.MapW+y][p]
-/*					ox := bmp.OffX
-					oy := bmp.OffY*/
-					bw, bh := bmp.W, bmp.H
-					if viewport.OnScreen(px, py, bw, bh) {
-						gl.Begin(gl.QUADS)
-						bmp.Tex.Bind(gl.TEXTURE_2D)
-						gl.TexCoord2f(0, 0); gl.Vertex3i(px, py, 0)
-						gl.TexCoord2f(0, 1); gl.Vertex3i(px, py+bw, 0)
-						gl.TexCoord2f(1, 1); gl.Vertex3i(px+bh, py+bw, 0)
-						gl.TexCoord2f(1, 0); gl.Vertex3i(px+bh, py, 0)
-						gl.End()
-					}
+				if ground {
+					overlays.drawGround(tile, px, py, outline)
 				}
-			}
+			})
 		}
 		
 
 		gl.Flush()
+		d.resourceManager.EndFrame()
 	})
 
 	var trans allegro.Transform
 	trans.Identity()
 	trans.Use()
 
-	font.Draw(allegro.CreateColor(0, 255, 0, 255), 0, 0, 0, fmt.Sprint(int(d.fps)))
+	d.drawLabels(viewport)
+	d.drawMinimap(viewport)
+	d.drawUI()
 
-	allegro.Flip()
+	stats := d.resourceManager.GetTextureStats()
+	debug := DefaultTextStyle()
+	debug.Color = allegro.CreateColor(0, 255, 0, 255)
+	d.drawText(0, 0, fmt.Sprintf("%v\ntex %v (%vMB/%vMB) pending %v evicted %v",
+		int(d.fps), stats.Textures, stats.Bytes>>20, stats.Budget>>20,
+		stats.Pending, stats.Evictions), debug)
 
-	d.frameDrawing.Unlock()
+	allegro.Flip()
 }
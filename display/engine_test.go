@@ -0,0 +1,95 @@
+package display
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts its GameFinished calls, and checks nothing is still running by then
+type fakeGame struct {
+	t        *testing.T
+	busy     *int32
+	finished int32
+}
+
+func (g *fakeGame) GetDisplayConfig() DisplayConfig      { return DisplayConfig{} }
+func (g *fakeGame) GetTile(x, y int) []DrawItem          { return nil }
+func (g *fakeGame) RegisterDisplayEngine(*DisplayEngine) {}
+func (g *fakeGame) GameFinished() {
+	atomic.AddInt32(&g.finished, 1)
+	if n := atomic.LoadInt32(g.busy); n != 0 {
+		g.t.Errorf("GameFinished called with %v goroutines still running", n)
+	}
+}
+
+// An engine without a display, whose event handler and frames count
+// themselves in busy while they run
+func createFakeEngine(t *testing.T, busy *int32) (*DisplayEngine, *fakeGame) {
+	game := &fakeGame{t: t, busy: busy}
+	var gameEngine GameEngine = game
+	d := &DisplayEngine{
+		gameEngine: &gameEngine,
+		quit:       make(chan struct{}),
+		closed:     make(chan struct{}),
+		entities:   createEntities(),
+	}
+	d.teardown = func() {
+		if n := atomic.LoadInt32(busy); n != 0 {
+			t.Errorf("torn down with %v goroutines still running", n)
+		}
+	}
+	return d, game
+}
+
+func TestShutdownJoinsWorkers(t *testing.T) {
+	var busy, frames int32
+	d, game := createFakeEngine(t, &busy)
+	listening := make(chan struct{})
+	d.listen = func() {
+		atomic.AddInt32(&busy, 1)
+		defer atomic.AddInt32(&busy, -1)
+		close(listening)
+		<-d.quit
+		// Slower to finish than the frames, so Wait has to join it
+		time.Sleep(20 * time.Millisecond)
+	}
+	d.frame = func(alpha float64) {
+		atomic.AddInt32(&busy, 1)
+		defer atomic.AddInt32(&busy, -1)
+		atomic.AddInt32(&frames, 1)
+		time.Sleep(time.Millisecond)
+	}
+
+	go d.Run()
+	<-listening
+	for atomic.LoadInt32(&frames) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	d.Stop()
+	d.Wait()
+	// Safe to call again, and from more than one place
+	d.Stop()
+	d.Wait()
+
+	if n := atomic.LoadInt32(&busy); n != 0 {
+		t.Errorf("%v goroutines still running after Wait", n)
+	}
+	if n := atomic.LoadInt32(&game.finished); n != 1 {
+		t.Errorf("GameFinished called %v times, want once", n)
+	}
+}
+
+func TestWaitWithoutRun(t *testing.T) {
+	var busy int32
+	d, game := createFakeEngine(t, &busy)
+	d.listen = func() { t.Error("event handler started by Run after Wait") }
+	d.frame = func(alpha float64) { t.Error("frame drawn by Run after Wait") }
+
+	d.Wait()
+	d.Run()
+	d.Wait()
+	if n := atomic.LoadInt32(&game.finished); n != 1 {
+		t.Errorf("GameFinished called %v times, want once", n)
+	}
+}
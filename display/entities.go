@@ -0,0 +1,216 @@
+package display
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The frames of an animated sprite, for each direction it can face
+type Animation struct {
+	// Tile names, indexed by direction, then frame. Directions are numbered
+	// clockwise, and there should be a multiple of four of them so the
+	// sprites can follow the view's rotation. The tiles are looked up every
+	// frame, so show up once they have loaded.
+	Frames [][]string
+	// How long each frame is shown for
+	FrameTime time.Duration
+	// From the bottom centre of the bitmap to the entity's position, e.g. to
+	// line up a walker's feet
+	OffX, OffY int
+}
+
+// Something drawn at a point within a tile rather than on a whole tile, such
+// as a walker moving between tiles. Positions are set once per game tick and
+// interpolated between ticks when drawn.
+type Entity struct {
+	// Where the entity was at the last two ticks, and where it has been
+	// moved to since
+	prevX, prevY float64
+	x, y         float64
+	nextX, nextY float64
+
+	direction int
+	anim      *Animation
+	animStart time.Time
+	item      DrawItem
+}
+
+// The game's entities, and the timing of its ticks
+type entities struct {
+	lock sync.Mutex
+	all  map[*Entity]bool
+
+	lastTick time.Time
+	tickLen  time.Duration
+}
+
+func createEntities() *entities {
+	return &entities{all: make(map[*Entity]bool)}
+}
+
+// Adds an entity at the given point in tile coordinates, drawn in the walkers
+// layer. The centre of tile (x, y) is at (x+0.5, y+0.5).
+func (d *DisplayEngine) AddEntity(x, y float64, direction int, anim *Animation) *Entity {
+	e := &Entity{
+		prevX: x, prevY: y,
+		x: x, y: y,
+		nextX: x, nextY: y,
+		direction: direction,
+		anim:      anim,
+		animStart: time.Now(),
+		item:      NewDrawItem(nil),
+	}
+	e.item.Layer = LAYER_WALKERS
+	d.entities.lock.Lock()
+	d.entities.all[e] = true
+	d.entities.lock.Unlock()
+	return e
+}
+
+// Moves the entity. It is drawn moving smoothly to its new position over the
+// next tick, once CommitTick is called.
+func (d *DisplayEngine) MoveEntity(e *Entity, x, y float64, direction int) {
+	d.entities.lock.Lock()
+	e.nextX, e.nextY = x, y
+	e.direction = direction
+	d.entities.lock.Unlock()
+}
+
+// Moves the entity without drawing it moving there, e.g. when it first
+// leaves a building
+func (d *DisplayEngine) PlaceEntity(e *Entity, x, y float64, direction int) {
+	d.entities.lock.Lock()
+	e.prevX, e.prevY = x, y
+	e.x, e.y = x, y
+	e.nextX, e.nextY = x, y
+	e.direction = direction
+	d.entities.lock.Unlock()
+}
+
+// Changes the entity's animation, restarting it from the first frame
+func (d *DisplayEngine) SetEntityAnimation(e *Entity, anim *Animation) {
+	d.entities.lock.Lock()
+	e.anim = anim
+	e.animStart = time.Now()
+	d.entities.lock.Unlock()
+}
+
+// Sets how the entity's sprite is drawn. The item's bitmap is ignored; it is
+// taken from the animation.
+func (d *DisplayEngine) SetEntityStyle(e *Entity, item DrawItem) {
+	if item.Layer == "" {
+		item.Layer = LAYER_WALKERS
+	}
+	d.entities.lock.Lock()
+	e.item = item
+	d.entities.lock.Unlock()
+}
+
+func (d *DisplayEngine) RemoveEntity(e *Entity) {
+	d.entities.lock.Lock()
+	delete(d.entities.all, e)
+	d.entities.lock.Unlock()
+}
+
+// Marks the end of a game tick. Entities are drawn moving from where they
+// were at the previous tick to where they were moved during this one, taking
+// as long as the last tick took. Called by the display engine if the
+// GameEngine is an Updater.
+func (d *DisplayEngine) CommitTick() {
+	d.entities.lock.Lock()
+	now := time.Now()
+	if !d.entities.lastTick.IsZero() {
+		d.entities.tickLen = now.Sub(d.entities.lastTick)
+	}
+	d.entities.lastTick = now
+	for e := range d.entities.all {
+		e.prevX, e.prevY = e.x, e.y
+		e.x, e.y = e.nextX, e.nextY
+	}
+	d.entities.lock.Unlock()
+}
+
+// How far through the current tick the frame is, from 0 to 1. Must be called
+// with the lock held.
+func (es *entities) alpha() float64 {
+	if es.tickLen <= 0 {
+		return 1
+	}
+	return math.Min(1, float64(time.Since(es.lastTick))/float64(es.tickLen))
+}
+
+// An entity as it should be drawn this frame
+type entitySprite struct {
+	item   DrawItem
+	px, py int
+	// The screen y of the sprite's bottom edge, for sorting
+	bottom int
+}
+
+// Works out where each entity is drawn this frame, and sorts them into the
+// layer and tile they are drawn with, alpha of the way from their previous
+// positions to their current ones. Returns sprites indexed by layer, then
+// tile, each sorted back to front.
+func (d *DisplayEngine) placeEntities(viewport Viewport, projection Projection, lifts []int, alpha float64) [][][]entitySprite {
+	placed := make([][][]entitySprite, len(d.layers.names))
+
+	d.entities.lock.Lock()
+	now := time.Now()
+	for e := range d.entities.all {
+		if e.anim == nil || len(e.anim.Frames) == 0 {
+			continue
+		}
+		tx := e.prevX + (e.x-e.prevX)*alpha
+		ty := e.prevY + (e.y-e.prevY)*alpha
+		x, y := int(math.Floor(tx)), int(math.Floor(ty))
+		if x < 0 || x >= d.config.MapW || y < 0 || y >= d.config.MapH {
+			continue
+		}
+
+		// Turn the sprite with the view
+		n := len(e.anim.Frames)
+		dir := e.direction
+		if n%4 == 0 {
+			dir += viewport.rotation * n / 4
+		}
+		frames := e.anim.Frames[((dir%n)+n)%n]
+		if len(frames) == 0 {
+			continue
+		}
+		frame := 0
+		if e.anim.FrameTime > 0 {
+			frame = int(now.Sub(e.animStart)/e.anim.FrameTime) % len(frames)
+		}
+
+		item := e.item
+		item.Bitmap = d.resourceManager.GetTileOrDefault(frames[frame])
+		wx, wy := projection.TileToWorld(rotatePoint(tx, ty, viewport.rotation, d.config))
+		bw, bh := item.Bitmap.Size()
+		px := int(wx) - bw/2 + e.anim.OffX
+		py := int(wy) - bh + e.anim.OffY - lifts[x*d.config.MapH+y]
+		if viewport.OnScreen(item.area(px, py)) && !item.Bitmap.Ready() {
+			d.resourceManager.PrioritizeTile(item.Bitmap,
+				viewport.DistanceFromCentre(px, py))
+		}
+
+		l := d.layers.resolve(item, len(d.layers.names)-1)
+		if placed[l] == nil {
+			placed[l] = make([][]entitySprite, d.config.MapW*d.config.MapH)
+		}
+		placed[l][x*d.config.MapH+y] = append(placed[l][x*d.config.MapH+y],
+			entitySprite{item, px, py, py + bh})
+	}
+	d.entities.lock.Unlock()
+
+	// Entities sharing a tile are drawn top of the screen first
+	for _, tiles := range placed {
+		for _, sprites := range tiles {
+			sort.Slice(sprites, func(i, j int) bool {
+				return sprites[i].bottom < sprites[j].bottom
+			})
+		}
+	}
+	return placed
+}
@@ -7,28 +7,74 @@ import (
 )
 
 func (d *DisplayEngine) eventHandler() {
-	src := d.Display.GetEventSource()
-	defer src.StopGetEvents()
-	es := []*allegro.EventSource{src, allegro.GetMouseEventSource()}
+	for {
+		d.drawLock.RLock()
+		src := d.Display.GetEventSource()
+		d.drawLock.RUnlock()
+		swap, stopped := d.handleEvents(src)
+		if stopped {
+			return
+		}
+		close(swap.detached)
+		select {
+		case <-swap.done:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// Handles events from the display, mouse and keyboard until the engine stops,
+// in which case it returns true, or the display is about to be recreated by a
+// mode change. Stops listening to every source before returning.
+func (d *DisplayEngine) handleEvents(src *allegro.EventSource) (displaySwap, bool) {
+	es := []*allegro.EventSource{src, allegro.GetMouseEventSource(),
+		allegro.GetKeyboardEventSource()}
 	queue := allegro.GetEvents(es)
+	defer func() {
+		for _, s := range es {
+			s.StopGetEvents()
+		}
+	}()
 	stopped := false
 	for !stopped {
-		ev := <-queue
+		var ev interface{}
+		select {
+		case ev = <-queue:
+		case swap := <-d.mode.swap:
+			return swap, false
+		case <-d.quit:
+			return displaySwap{}, true
+		}
 		switch tev := ev.(type) {
 		case allegro.DisplayCloseEvent:
-			d.statusLock.Lock()
-			d.running = false
-			d.statusLock.Unlock()
+			d.Stop()
 		case allegro.DisplayResizeEvent:
 			d.handleResize(tev)
+		case allegro.MouseAxes:
+			d.cursorLock.Lock()
+			d.cursorX, d.cursorY = float64(tev.X), float64(tev.Y)
+			d.cursorLock.Unlock()
+			d.ui.mouseMoved(tev.X, tev.Y, tev.DZ)
 		case allegro.MouseButtonDown:
-			tx, ty := d.viewport.ScreenCoordinatesToTile(tev.X, tev.Y, d.config)
+			// The UI gets first refusal on clicks
+			captured := d.ui.capturesMouse(tev.X, tev.Y)
+			d.ui.mouseButton(tev.X, tev.Y, true)
+			if captured || d.minimapClick(tev.X, tev.Y) {
+				break
+			}
+			tx, ty := d.ScreenCoordinatesToTile(tev.X, tev.Y)
 			log.Printf("S: (%v, %v) T: (%v, %v)", tev.X, tev.Y, tx, ty)
+		case allegro.MouseButtonUp:
+			d.ui.mouseButton(tev.X, tev.Y, false)
+		case allegro.KeyChar:
+			d.ui.keyTyped(tev.KeyCode, tev.Unichar)
 		}
 		d.statusLock.RLock()
 		stopped = !d.running
 		d.statusLock.RUnlock()
 	}
+	return displaySwap{}, true
 }
 
 
@@ -0,0 +1,120 @@
+package display
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	LAYER_GROUND    = "ground"
+	LAYER_ROADS     = "roads"
+	LAYER_BUILDINGS = "buildings"
+	LAYER_WALKERS   = "walkers"
+	LAYER_EFFECTS   = "effects"
+	LAYER_OVERLAYS  = "overlays"
+)
+
+// The layers used when DisplayConfig.Layers is empty, bottom first
+var DEFAULT_LAYERS = []string{LAYER_GROUND, LAYER_ROADS, LAYER_BUILDINGS,
+	LAYER_WALKERS, LAYER_EFFECTS, LAYER_OVERLAYS}
+
+// The named layers of the map, bottom first. Every tile's items in a layer are
+// drawn before any item in the layer above it.
+type layers struct {
+	names []string
+	index map[string]int
+
+	lock    sync.Mutex
+	hidden  map[string]bool
+	unknown map[string]bool
+}
+
+func createLayers(names []string) *layers {
+	if len(names) == 0 {
+		names = DEFAULT_LAYERS
+	}
+	l := &layers{
+		names:   names,
+		index:   make(map[string]int),
+		hidden:  make(map[string]bool),
+		unknown: make(map[string]bool),
+	}
+	for i, name := range names {
+		if _, ok := l.index[name]; ok {
+			log.Printf("Layer %q declared twice in DisplayConfig.Layers", name)
+			continue
+		}
+		l.index[name] = i
+	}
+	return l
+}
+
+// The index of the layer an item is drawn in. Items without a layer are drawn
+// in the layer matching their position in the tile's stack, so the first item
+// is drawn on the ground. Items in undeclared layers are drawn on top.
+func (l *layers) resolve(item DrawItem, stackIndex int) int {
+	if item.Layer == "" {
+		if stackIndex >= len(l.names) {
+			return len(l.names) - 1
+		}
+		return stackIndex
+	}
+	if i, ok := l.index[item.Layer]; ok {
+		return i
+	}
+	l.lock.Lock()
+	if !l.unknown[item.Layer] {
+		l.unknown[item.Layer] = true
+		log.Printf("Layer %q not declared in DisplayConfig.Layers, drawing it on top",
+			item.Layer)
+	}
+	l.lock.Unlock()
+	return len(l.names) - 1
+}
+
+// The layer ghosts are drawn in, as they stand in for buildings: the
+// buildings layer if there is one, otherwise the second layer
+func (l *layers) ghostLayer() int {
+	if i, ok := l.index[LAYER_BUILDINGS]; ok {
+		return i
+	}
+	if len(l.names) < 2 {
+		return 0
+	}
+	return 1
+}
+
+// Which layers are being drawn, indexed like names
+func (l *layers) visible() []bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	visible := make([]bool, len(l.names))
+	for i, name := range l.names {
+		visible[i] = !l.hidden[name]
+	}
+	return visible
+}
+
+// The names of the layers, bottom first
+func (d *DisplayEngine) GetLayers() []string {
+	return append([]string(nil), d.layers.names...)
+}
+
+// Shows or hides every item in the layer, e.g. to debug what is underneath.
+// Overlays are still drawn when their layer is hidden.
+func (d *DisplayEngine) SetLayerVisible(name string, visible bool) {
+	if _, ok := d.layers.index[name]; !ok {
+		log.Printf("Can not show or hide undeclared layer %q", name)
+		return
+	}
+	d.layers.lock.Lock()
+	d.layers.hidden[name] = !visible
+	d.layers.lock.Unlock()
+}
+
+func (d *DisplayEngine) IsLayerVisible(name string) bool {
+	d.layers.lock.Lock()
+	defer d.layers.lock.Unlock()
+	_, ok := d.layers.index[name]
+	return ok && !d.layers.hidden[name]
+}
@@ -0,0 +1,284 @@
+package display
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sync"
+
+	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+
+	"github.com/bluepeppers/danckelmann/resources"
+)
+
+// Optionally implemented by a GameEngine to have a minimap drawn. Called for
+// every tile when the minimap is first shown, then only for tiles passed to
+// DisplayEngine.InvalidateMinimapTile.
+type MinimapColorer interface {
+	GetMinimapColor(x, y int) allegro.Color
+}
+
+// A thumbnail of the whole map, laid out by the map's projection, with the
+// area the viewport covers outlined. Each pixel covers half a tile's width and
+// height, so the thumbnail has the same proportions as the map.
+type minimap struct {
+	lock    sync.Mutex
+	visible bool
+	screen  rect
+
+	pixels   *image.RGBA
+	dirty    map[[2]int]bool
+	allDirty bool
+	// The view rotation the thumbnail was laid out with
+	rotation int
+	// The point on the map at the thumbnail's top left
+	originX, originY float64
+	// The thumbnail pixels each tile covers, indexed by x*MapH+y
+	tilePixels [][]image.Point
+
+	tex        gl.Texture
+	created    bool
+	needUpload bool
+}
+
+// Shows the minimap in the given area of the screen. Does nothing unless the
+// GameEngine implements MinimapColorer.
+func (d *DisplayEngine) ShowMinimap(x, y, w, h int) {
+	m := &d.minimap
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.visible = true
+	m.screen = rect{x, y, w, h}
+	if m.dirty == nil {
+		m.dirty = make(map[[2]int]bool)
+		m.allDirty = true
+	}
+}
+
+func (d *DisplayEngine) HideMinimap() {
+	d.minimap.lock.Lock()
+	d.minimap.visible = false
+	d.minimap.lock.Unlock()
+}
+
+// Marks the tile's minimap colour as changed, so it will be fetched again
+func (d *DisplayEngine) InvalidateMinimapTile(x, y int) {
+	d.minimap.lock.Lock()
+	if d.minimap.dirty != nil {
+		d.minimap.dirty[[2]int{x, y}] = true
+	}
+	d.minimap.lock.Unlock()
+}
+
+// Marks every tile's minimap colour as changed
+func (d *DisplayEngine) InvalidateMinimap() {
+	d.minimap.lock.Lock()
+	d.minimap.allDirty = true
+	d.minimap.lock.Unlock()
+}
+
+// Sizes the thumbnail to fit the map as seen with the rotation, and works out
+// which tile each pixel shows. Must be called with the lock held.
+func (d *DisplayEngine) layoutMinimap(rotation int) {
+	m := &d.minimap
+	m.rotation = rotation
+	projection := d.config.GetProjection()
+	w, h := float64(d.config.TileW), float64(d.config.TileH)
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	viewW, viewH := viewDimensions(rotation, d.config)
+	if viewW <= 0 || viewH <= 0 {
+		// An empty map, so an empty thumbnail, which isn't drawn
+		m.pixels = image.NewRGBA(image.Rectangle{})
+		m.tilePixels = nil
+		return
+	}
+	for vx := 0; vx < viewW; vx++ {
+		for vy := 0; vy < viewH; vy++ {
+			ox, oy := projection.TileOrigin(vx, vy)
+			minX, minY = math.Min(minX, float64(ox)), math.Min(minY, float64(oy))
+			maxX, maxY = math.Max(maxX, float64(ox)+w), math.Max(maxY, float64(oy)+h)
+		}
+	}
+	m.originX, m.originY = minX, minY
+	pw := int(math.Ceil((maxX - minX) / (w / 2)))
+	ph := int(math.Ceil((maxY - minY) / (h / 2)))
+	m.pixels = image.NewRGBA(image.Rect(0, 0, pw, ph))
+
+	m.tilePixels = make([][]image.Point, d.config.MapW*d.config.MapH)
+	for py := 0; py < ph; py++ {
+		for px := 0; px < pw; px++ {
+			// Sampled off the pixel's centre, which can fall on the edge
+			// between two diamond shaped tiles
+			wx, wy := d.minimapToWorld(float64(px)+0.75, float64(py)+0.5)
+			tx, ty := projection.WorldToTile(wx, wy)
+			tx, ty = unrotatePoint(tx, ty, rotation, d.config)
+			x, y := int(math.Floor(tx)), int(math.Floor(ty))
+			if x < 0 || x >= d.config.MapW || y < 0 || y >= d.config.MapH {
+				continue
+			}
+			m.tilePixels[x*d.config.MapH+y] = append(m.tilePixels[x*d.config.MapH+y],
+				image.Point{px, py})
+		}
+	}
+}
+
+// Refetches the colours of changed tiles, laying out the thumbnail again if
+// the view has been rotated. Must be called with the lock held.
+func (d *DisplayEngine) updateMinimap(colorer MinimapColorer, rotation int) {
+	m := &d.minimap
+	if m.pixels == nil || rotation != m.rotation {
+		d.layoutMinimap(rotation)
+		m.allDirty = true
+	}
+	set := func(x, y int) {
+		r, g, b, a := colorer.GetMinimapColor(x, y).GetRGBA()
+		c := color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a)}
+		for _, p := range m.tilePixels[x*d.config.MapH+y] {
+			m.pixels.SetRGBA(p.X, p.Y, c)
+		}
+	}
+
+	if m.allDirty {
+		for x := 0; x < d.config.MapW; x++ {
+			for y := 0; y < d.config.MapH; y++ {
+				set(x, y)
+			}
+		}
+		m.allDirty = false
+		m.needUpload = true
+	} else if len(m.dirty) > 0 {
+		for tile := range m.dirty {
+			if tile[0] >= 0 && tile[0] < d.config.MapW &&
+				tile[1] >= 0 && tile[1] < d.config.MapH {
+				set(tile[0], tile[1])
+			}
+		}
+		m.needUpload = true
+	}
+	m.dirty = make(map[[2]int]bool)
+}
+
+// Converts a point on the thumbnail to pixel coordinates on the map. Must be
+// called with the lock held.
+func (d *DisplayEngine) minimapToWorld(mx, my float64) (float64, float64) {
+	w, h := float64(d.config.TileW), float64(d.config.TileH)
+	return d.minimap.originX + mx*w/2, d.minimap.originY + my*h/2
+}
+
+// Converts pixel coordinates on the map to a point on the thumbnail. Must be
+// called with the lock held.
+func (d *DisplayEngine) worldToMinimap(wx, wy float64) (float64, float64) {
+	w, h := float64(d.config.TileW), float64(d.config.TileH)
+	return (wx - d.minimap.originX) / (w / 2), (wy - d.minimap.originY) / (h / 2)
+}
+
+// Whether there is an area of the screen to draw the thumbnail in, and a map
+// to draw in it. Must be called with the lock held.
+func (m *minimap) drawable() bool {
+	return m.screen.w > 0 && m.screen.h > 0 && m.pixels != nil && !m.pixels.Bounds().Empty()
+}
+
+// Whether the point is on the minimap. If it is, the viewport is centred on
+// the part of the map clicked.
+func (d *DisplayEngine) minimapClick(sx, sy int) bool {
+	m := &d.minimap
+	m.lock.Lock()
+	if !m.visible || !m.drawable() || !m.screen.contains(sx, sy) {
+		m.lock.Unlock()
+		return false
+	}
+	bounds := m.pixels.Bounds()
+	mx := float64(sx-m.screen.x) * float64(bounds.Dx()) / float64(m.screen.w)
+	my := float64(sy-m.screen.y) * float64(bounds.Dy()) / float64(m.screen.h)
+	wx, wy := d.minimapToWorld(mx, my)
+	m.lock.Unlock()
+
+	d.drawLock.Lock()
+	v := &d.viewport
+	v.x = int(wx - float64(v.w)*v.xZoom/2)
+	v.y = int(wy - float64(v.h)*v.yZoom/2)
+	v.buildTrans()
+	d.drawLock.Unlock()
+	return true
+}
+
+// Draws the minimap, if it's visible. The current transform must be the
+// identity.
+func (d *DisplayEngine) drawMinimap(viewport Viewport) {
+	colorer, ok := (*d.gameEngine).(MinimapColorer)
+	if !ok {
+		return
+	}
+	m := &d.minimap
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.visible {
+		return
+	}
+	d.updateMinimap(colorer, viewport.rotation)
+	if !m.drawable() {
+		return
+	}
+
+	// The viewport's outline, in screen coordinates
+	bounds := m.pixels.Bounds()
+	scaleX := float64(m.screen.w) / float64(bounds.Dx())
+	scaleY := float64(m.screen.h) / float64(bounds.Dy())
+	x0, y0 := d.worldToMinimap(float64(viewport.x), float64(viewport.y))
+	x1, y1 := d.worldToMinimap(
+		float64(viewport.x)+float64(viewport.w)*viewport.xZoom,
+		float64(viewport.y)+float64(viewport.h)*viewport.yZoom)
+	outline := [4]float32{
+		float32(float64(m.screen.x) + x0*scaleX),
+		float32(float64(m.screen.y) + y0*scaleY),
+		float32(float64(m.screen.x) + x1*scaleX),
+		float32(float64(m.screen.y) + y1*scaleY),
+	}
+	s := m.screen
+
+	allegro.RunInThread(func() {
+		if !m.created {
+			m.tex = gl.GenTexture()
+			m.tex.Bind(gl.TEXTURE_2D)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+			m.created = true
+			m.needUpload = true
+		}
+		if m.needUpload {
+			m.tex.Bind(gl.TEXTURE_2D)
+			gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, bounds.Dx(), bounds.Dy(), 0,
+				gl.RGBA, gl.UNSIGNED_BYTE, m.pixels.Pix)
+			m.needUpload = false
+		}
+
+		resources.WithScreenProjection(func() {
+			gl.Enable(gl.TEXTURE_2D)
+			m.tex.Bind(gl.TEXTURE_2D)
+			gl.Color4f(1, 1, 1, 1)
+			gl.Begin(gl.QUADS)
+			gl.TexCoord2f(0, 0); gl.Vertex2i(s.x, s.y)
+			gl.TexCoord2f(0, 1); gl.Vertex2i(s.x, s.y+s.h)
+			gl.TexCoord2f(1, 1); gl.Vertex2i(s.x+s.w, s.y+s.h)
+			gl.TexCoord2f(1, 0); gl.Vertex2i(s.x+s.w, s.y)
+			gl.End()
+
+			gl.Disable(gl.TEXTURE_2D)
+			gl.Enable(gl.SCISSOR_TEST)
+			var glViewport [4]int32
+			gl.GetIntegerv(gl.VIEWPORT, glViewport[:])
+			gl.Scissor(s.x, int(glViewport[3])-s.y-s.h, s.w, s.h)
+			gl.Begin(gl.LINE_LOOP)
+			gl.Vertex2f(outline[0], outline[1])
+			gl.Vertex2f(outline[0], outline[3])
+			gl.Vertex2f(outline[2], outline[3])
+			gl.Vertex2f(outline[2], outline[1])
+			gl.End()
+			gl.Disable(gl.SCISSOR_TEST)
+			gl.Enable(gl.TEXTURE_2D)
+		})
+	})
+}
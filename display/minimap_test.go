@@ -0,0 +1,36 @@
+package display
+
+import "testing"
+
+func TestMinimapNothingToDraw(t *testing.T) {
+	d := &DisplayEngine{config: DisplayConfig{TileW: 64, TileH: 32}}
+	m := &d.minimap
+	m.visible = true
+	m.screen = rect{0, 0, 100, 100}
+
+	// An empty map
+	d.layoutMinimap(0)
+	if m.drawable() {
+		t.Error("minimap of an empty map drawable")
+	}
+	if d.minimapClick(10, 10) {
+		t.Error("click on the minimap of an empty map handled")
+	}
+
+	// No area to draw in
+	d.config.MapW, d.config.MapH = 4, 4
+	d.layoutMinimap(0)
+	for _, screen := range []rect{{0, 0, 0, 100}, {0, 0, 100, 0}, {0, 0, -10, -10}} {
+		m.screen = screen
+		if m.drawable() {
+			t.Errorf("minimap in %+v drawable", screen)
+		}
+		if d.minimapClick(0, 0) {
+			t.Errorf("click on the minimap in %+v handled", screen)
+		}
+	}
+	m.screen = rect{0, 0, 100, 100}
+	if !m.drawable() {
+		t.Error("minimap of a 4x4 map not drawable")
+	}
+}
@@ -0,0 +1,242 @@
+package display
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/bluepeppers/allegro"
+
+	"github.com/bluepeppers/danckelmann/config"
+)
+
+// How the display covers the screen
+type WindowMode int
+
+const (
+	MODE_WINDOWED WindowMode = iota
+	// Changes the monitor's resolution
+	MODE_FULLSCREEN
+	// A borderless window covering the monitor at its current resolution
+	MODE_FULLSCREEN_WINDOW
+)
+
+// Everything about how the display is created. Read from the display section
+// of the user's config, and changed at runtime with SetDisplayMode.
+type DisplayMode struct {
+	Window WindowMode
+	// The size of the window, or the resolution in fullscreen. Ignored for
+	// fullscreen windows, which cover the monitor.
+	Width, Height int
+	// In Hz, or 0 for any. Only used in fullscreen.
+	Refresh int
+	// Index of the monitor to create the display on, or -1 for the default
+	Monitor int
+	VSync   bool
+	// Samples per pixel for multisampling, or 0 to turn it off
+	Samples int
+}
+
+// A mode change waiting to be applied between frames
+type modeRequest struct {
+	mode   DisplayMode
+	result chan error
+}
+
+// Sent to the event handler before the display is recreated. The handler
+// stops listening to the old display, closes detached, then waits for done
+// before listening to the new one.
+type displaySwap struct {
+	detached chan struct{}
+	done     chan struct{}
+}
+
+// The current mode, and changes asked for since the last frame
+type modeState struct {
+	lock    sync.Mutex
+	current DisplayMode
+	pending []modeRequest
+	// Received by the event handler, so the display is only destroyed
+	// once nothing is listening to it
+	swap chan displaySwap
+}
+
+// Converts the display section of the user's config to a mode
+func readDisplayMode(settings config.DisplaySettings) DisplayMode {
+	var mode DisplayMode
+	switch settings.Windowed {
+	case "fullscreen":
+		mode.Window = MODE_FULLSCREEN
+	case "windowed":
+		mode.Window = MODE_WINDOWED
+	default:
+		mode.Window = MODE_FULLSCREEN_WINDOW
+	}
+	mode.Width, mode.Height = settings.Width, settings.Height
+	mode.Refresh = settings.Refresh
+	mode.Monitor = settings.Monitor
+	mode.VSync = settings.VSync
+	mode.Samples = settings.Samples
+
+	// Only known once allegro is running, so can't be checked by the schema
+	if mode.Monitor >= allegro.GetNumVideoAdapters() {
+		log.Printf("display.monitor=%v but there are only %v monitors",
+			mode.Monitor, allegro.GetNumVideoAdapters())
+		log.Printf("Defaulting to display.monitor=-1")
+		mode.Monitor = -1
+	}
+	return mode
+}
+
+func createDisp(mode DisplayMode) (*allegro.Display, error) {
+	allegro.SetNewDisplayAdapter(mode.Monitor)
+	if mode.Window == MODE_FULLSCREEN {
+		allegro.SetNewDisplayRefreshRate(mode.Refresh)
+	} else {
+		allegro.SetNewDisplayRefreshRate(0)
+	}
+	// 1 forces vsync on, 2 forces it off
+	if mode.VSync {
+		allegro.SetNewDisplayOption(allegro.VSYNC, 1, allegro.SUGGEST)
+	} else {
+		allegro.SetNewDisplayOption(allegro.VSYNC, 2, allegro.SUGGEST)
+	}
+	if mode.Samples > 0 {
+		allegro.SetNewDisplayOption(allegro.SAMPLE_BUFFERS, 1, allegro.SUGGEST)
+		allegro.SetNewDisplayOption(allegro.SAMPLES, mode.Samples, allegro.SUGGEST)
+	} else {
+		allegro.SetNewDisplayOption(allegro.SAMPLE_BUFFERS, 0, allegro.SUGGEST)
+		allegro.SetNewDisplayOption(allegro.SAMPLES, 0, allegro.SUGGEST)
+	}
+
+	flags := allegro.RESIZABLE
+	switch mode.Window {
+	case MODE_FULLSCREEN:
+		flags |= allegro.FULLSCREEN
+	case MODE_WINDOWED:
+		flags |= allegro.WINDOWED
+	default:
+		flags |= allegro.FULLSCREEN_WINDOW
+	}
+	disp := allegro.CreateDisplay(mode.Width, mode.Height, flags)
+	if disp == nil {
+		return nil, fmt.Errorf("%w in mode %+v", ErrCreateDisplay, mode)
+	}
+	return disp, nil
+}
+
+// The fullscreen resolutions and refresh rates the monitor supports, or the
+// default monitor if it is -1
+func ListDisplayModes(monitor int) []DisplayMode {
+	allegro.SetNewDisplayAdapter(monitor)
+	var modes []DisplayMode
+	for i := 0; i < allegro.GetNumDisplayModes(); i++ {
+		m := allegro.GetDisplayMode(i)
+		if m == nil {
+			continue
+		}
+		modes = append(modes, DisplayMode{
+			Window:  MODE_FULLSCREEN,
+			Width:   m.Width,
+			Height:  m.Height,
+			Refresh: m.RefreshRate,
+			Monitor: monitor,
+		})
+	}
+	return modes
+}
+
+func (d *DisplayEngine) GetDisplayMode() DisplayMode {
+	d.mode.lock.Lock()
+	defer d.mode.lock.Unlock()
+	return d.mode.current
+}
+
+// Switches to the mode before the next frame is drawn, without restarting.
+// The returned channel receives the result once the switch is done; if it
+// fails, the old mode is kept. Don't wait on it from GameEngine methods or UI
+// functions, as they run before the switch can happen.
+func (d *DisplayEngine) SetDisplayMode(mode DisplayMode) <-chan error {
+	result := make(chan error, 1)
+	d.mode.lock.Lock()
+	d.mode.pending = append(d.mode.pending, modeRequest{mode, result})
+	d.mode.lock.Unlock()
+	return result
+}
+
+// Applies any mode changes asked for. Must be called between frames.
+func (d *DisplayEngine) applyDisplayModes() {
+	d.mode.lock.Lock()
+	pending := d.mode.pending
+	d.mode.pending = nil
+	d.mode.lock.Unlock()
+
+	for _, req := range pending {
+		err := d.switchDisplayMode(req.mode)
+		if err != nil {
+			log.Printf("Could not switch display mode: %v", err)
+		}
+		req.result <- err
+	}
+}
+
+func (d *DisplayEngine) switchDisplayMode(mode DisplayMode) error {
+	d.mode.lock.Lock()
+	current := d.mode.current
+	d.mode.lock.Unlock()
+
+	// Going in or out of a fullscreen window, or resizing a window, can be
+	// done to the existing display. Anything else needs a new one.
+	live := mode.Window != MODE_FULLSCREEN && current.Window != MODE_FULLSCREEN &&
+		mode.Monitor == current.Monitor && mode.VSync == current.VSync &&
+		mode.Samples == current.Samples
+	if !live {
+		// The event handler may be waiting on drawLock, so is detached
+		// before taking it
+		swap := displaySwap{make(chan struct{}), make(chan struct{})}
+		select {
+		case d.mode.swap <- swap:
+			<-swap.detached
+		case <-d.quit:
+			return fmt.Errorf("%w: the engine is stopping", ErrCreateDisplay)
+		}
+		// Runs before drawLock is released, so the handler then waits
+		// for the switch to finish before listening again
+		defer close(swap.done)
+	}
+
+	d.drawLock.Lock()
+	defer d.drawLock.Unlock()
+
+	if live {
+		fullscreen := mode.Window == MODE_FULLSCREEN_WINDOW
+		if !d.Display.SetDisplayFlag(allegro.FULLSCREEN_WINDOW, fullscreen) {
+			return fmt.Errorf("%w: could not toggle fullscreen window", ErrCreateDisplay)
+		}
+		if !fullscreen && !d.Display.Resize(mode.Width, mode.Height) {
+			return fmt.Errorf("%w: could not resize to %vx%v", ErrCreateDisplay,
+				mode.Width, mode.Height)
+		}
+	} else {
+		disp, err := createDisp(mode)
+		if err != nil {
+			return err
+		}
+		// The GL context went with the old display, so every texture has
+		// to be uploaded again
+		d.Display.Destroy()
+		d.Display = disp
+		d.resourceManager.ResetTextures()
+		d.minimap.lock.Lock()
+		d.minimap.created = false
+		d.minimap.lock.Unlock()
+	}
+
+	w, h := d.Display.GetDimensions()
+	d.viewport.ResizeViewport(w, h)
+
+	d.mode.lock.Lock()
+	d.mode.current = mode
+	d.mode.lock.Unlock()
+	return nil
+}
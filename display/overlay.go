@@ -0,0 +1,144 @@
+package display
+
+import (
+	"sync"
+
+	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+
+	"github.com/bluepeppers/danckelmann/resources"
+)
+
+// The position of a tile on the map
+type TilePos struct {
+	X, Y int
+}
+
+// A bitmap drawn on a tile as a preview, e.g. of a building about to be placed
+type ghost struct {
+	bmp  *resources.Bitmap
+	tint allegro.Color
+}
+
+// Highlights, outlines and ghosts drawn over the map within the tile pass.
+// Highlights and outlines are drawn with the bottom layer, beneath anything
+// standing on the tile; ghosts are drawn with the tile's items in the
+// buildings layer, so things in front of them still cover them.
+type overlays struct {
+	lock       sync.Mutex
+	highlights map[TilePos][]allegro.Color
+	outlines   map[TilePos][]allegro.Color
+	ghosts     map[TilePos][]ghost
+}
+
+func createOverlays() *overlays {
+	return &overlays{
+		highlights: make(map[TilePos][]allegro.Color),
+		outlines:   make(map[TilePos][]allegro.Color),
+		ghosts:     make(map[TilePos][]ghost),
+	}
+}
+
+// Fills the tiles' outlines with the colour. Use a translucent colour to let
+// the ground show through.
+func (d *DisplayEngine) HighlightTiles(tiles []TilePos, color allegro.Color) {
+	d.overlays.lock.Lock()
+	for _, tile := range tiles {
+		d.overlays.highlights[tile] = append(d.overlays.highlights[tile], color)
+	}
+	d.overlays.lock.Unlock()
+}
+
+// Draws the outlines of the tiles in the colour, e.g. for the
+// selection or the hovered tile
+func (d *DisplayEngine) OutlineTiles(tiles []TilePos, color allegro.Color) {
+	d.overlays.lock.Lock()
+	for _, tile := range tiles {
+		d.overlays.outlines[tile] = append(d.overlays.outlines[tile], color)
+	}
+	d.overlays.lock.Unlock()
+}
+
+// Draws the bitmap on the tile, tinted by the colour. Typically a building
+// placement preview, tinted green or red for valid and invalid placements. A
+// nil bitmap is ignored.
+func (d *DisplayEngine) SetGhost(bmp *resources.Bitmap, tileX, tileY int, tint allegro.Color) {
+	if bmp == nil {
+		return
+	}
+	tile := TilePos{tileX, tileY}
+	d.overlays.lock.Lock()
+	d.overlays.ghosts[tile] = append(d.overlays.ghosts[tile], ghost{bmp: bmp, tint: tint})
+	d.overlays.lock.Unlock()
+}
+
+// Removes all highlights, outlines and ghosts
+func (d *DisplayEngine) ClearOverlays() {
+	d.overlays.lock.Lock()
+	d.overlays.highlights = make(map[TilePos][]allegro.Color)
+	d.overlays.outlines = make(map[TilePos][]allegro.Color)
+	d.overlays.ghosts = make(map[TilePos][]ghost)
+	d.overlays.lock.Unlock()
+}
+
+// Copies the overlays, so they can be drawn without holding the lock, and
+// asks for the ghosts' bitmaps to be loaded first
+func (d *DisplayEngine) snapshotOverlays() *overlays {
+	d.overlays.lock.Lock()
+	defer d.overlays.lock.Unlock()
+	snap := createOverlays()
+	for tile, colors := range d.overlays.highlights {
+		snap.highlights[tile] = append([]allegro.Color(nil), colors...)
+	}
+	for tile, colors := range d.overlays.outlines {
+		snap.outlines[tile] = append([]allegro.Color(nil), colors...)
+	}
+	for tile, ghosts := range d.overlays.ghosts {
+		snap.ghosts[tile] = append([]ghost(nil), ghosts...)
+		for _, g := range ghosts {
+			// Ghosts follow the cursor, so are wanted before anything else
+			d.resourceManager.PrioritizeTile(g.bmp, 0)
+			d.resourceManager.MarkDrawn(g.bmp)
+		}
+	}
+	return snap
+}
+
+// Draws the tile's highlights and outlines, with the tile's top left at
+// (px, py). The outline is the projection's TileOutline. Must be called on the
+// render thread.
+func (o *overlays) drawGround(tile TilePos, px, py int, outline [][2]int) {
+	highlights, outlines := o.highlights[tile], o.outlines[tile]
+	if len(highlights) == 0 && len(outlines) == 0 {
+		return
+	}
+	shape := func(mode gl.GLenum) {
+		gl.Begin(mode)
+		for _, corner := range outline {
+			gl.Vertex2i(px+corner[0], py+corner[1])
+		}
+		gl.End()
+	}
+
+	gl.Disable(gl.TEXTURE_2D)
+	for _, color := range highlights {
+		setGLColor(color)
+		shape(gl.POLYGON)
+	}
+	for _, color := range outlines {
+		setGLColor(color)
+		shape(gl.LINE_LOOP)
+	}
+	gl.Color4f(1, 1, 1, 1)
+	gl.Enable(gl.TEXTURE_2D)
+}
+
+// Draws the tile's ghosts, with the tile's top left at (px, py). Must be called
+// on the render thread.
+func (o *overlays) drawGhosts(tile TilePos, px, py int) {
+	for _, g := range o.ghosts[tile] {
+		item := NewDrawItem(g.bmp)
+		item.Tint = g.tint
+		item.draw(px, py)
+	}
+}
@@ -0,0 +1,251 @@
+package display
+
+import (
+	"math"
+)
+
+// Which projection DisplayConfig.Projection selects
+type ProjectionType int
+
+const (
+	// Isometric, with the map drawn as one big diamond
+	PROJECTION_DIAMOND ProjectionType = iota
+	// Isometric, with alternate rows shifted half a tile so the map is drawn
+	// as a rectangle
+	PROJECTION_STAGGERED
+	// Top down, with square or rectangular tiles
+	PROJECTION_ORTHOGONAL
+	// Hexagons with a point at the top, alternate rows shifted right
+	PROJECTION_HEX_POINTY
+	// Hexagons with a flat top, alternate columns shifted down
+	PROJECTION_HEX_FLAT
+)
+
+// Maps tile coordinates to pixel coordinates on the map and back. All tiles
+// have a TileW by TileH bounding box. Tile coordinates are fractional within a
+// tile, so tile (x, y) covers [x, x+1) by [y, y+1).
+//
+// The view rotation is applied to tile coordinates before they are projected,
+// so is only meaningful for projections where a quarter turn maps the grid to
+// itself: diamond and orthogonal. The view can't be rotated with the others.
+// A custom projection is assumed to be rotatable.
+type Projection interface {
+	// The top left of the tile's bounding box
+	TileOrigin(x, y int) (int, int)
+	// Converts a point in tile coordinates to pixel coordinates on the map
+	TileToWorld(tx, ty float64) (float64, float64)
+	// Converts pixel coordinates on the map to tile coordinates
+	WorldToTile(wx, wy float64) (float64, float64)
+	// The corners of the tile's outline, clockwise from the top, relative
+	// to its origin
+	TileOutline() [][2]int
+	// Calls fn for every tile of a w by h map, back to front
+	DrawOrder(w, h int, fn func(x, y int))
+}
+
+// Returns the projection the config asks for
+func (config DisplayConfig) GetProjection() Projection {
+	if config.projection != nil {
+		return config.projection
+	}
+	if config.CustomProjection != nil {
+		return config.CustomProjection
+	}
+	return CreateProjection(config.Projection, config.TileW, config.TileH)
+}
+
+// Whether the view can be rotated with the config's projection
+func (config DisplayConfig) rotatable() bool {
+	switch {
+	case config.CustomProjection != nil:
+		return true
+	case config.Projection == PROJECTION_STAGGERED,
+		config.Projection == PROJECTION_HEX_POINTY,
+		config.Projection == PROJECTION_HEX_FLAT:
+		return false
+	}
+	return true
+}
+
+func CreateProjection(kind ProjectionType, tileW, tileH int) Projection {
+	w, h := tileW, tileH
+	fw, fh := float64(w), float64(h)
+	p := &layoutProjection{w: w, h: h}
+
+	// Most shapes are mapped to the tile's fractional coordinates by
+	// scaling their bounding box
+	p.local = func(fx, fy float64) (float64, float64) { return fx * fw, fy * fh }
+	p.unlocal = func(lx, ly float64) (float64, float64) { return lx / fw, ly / fh }
+	p.order = func(mw, mh int, fn func(x, y int)) {
+		for y := 0; y < mh; y++ {
+			for x := 0; x < mw; x++ {
+				fn(x, y)
+			}
+		}
+	}
+
+	switch kind {
+	case PROJECTION_STAGGERED:
+		p.layout = func(x, y int) (int, int) {
+			return x*w + (y&1)*w/2, y * h / 2
+		}
+		p.outline = [][2]int{{w / 2, 0}, {w, h / 2}, {w / 2, h}, {0, h / 2}}
+		p.local, p.unlocal = diamondLocal(fw, fh)
+		p.approx = func(wx, wy float64) (int, int) {
+			y := int(math.Floor(wy / (fh / 2)))
+			return int(math.Floor((wx - float64(y&1)*fw/2) / fw)), y
+		}
+
+	case PROJECTION_ORTHOGONAL:
+		p.layout = func(x, y int) (int, int) {
+			return x * w, y * h
+		}
+		p.outline = [][2]int{{0, 0}, {w, 0}, {w, h}, {0, h}}
+		p.approx = func(wx, wy float64) (int, int) {
+			return int(math.Floor(wx / fw)), int(math.Floor(wy / fh))
+		}
+
+	case PROJECTION_HEX_POINTY:
+		p.layout = func(x, y int) (int, int) {
+			return x*w + (y&1)*w/2, y * h * 3 / 4
+		}
+		p.outline = [][2]int{{w / 2, 0}, {w, h / 4}, {w, h * 3 / 4},
+			{w / 2, h}, {0, h * 3 / 4}, {0, h / 4}}
+		p.approx = func(wx, wy float64) (int, int) {
+			y := int(math.Floor(wy / (fh * 3 / 4)))
+			return int(math.Floor((wx - float64(y&1)*fw/2) / fw)), y
+		}
+
+	case PROJECTION_HEX_FLAT:
+		p.layout = func(x, y int) (int, int) {
+			return x * w * 3 / 4, y*h + (x&1)*h/2
+		}
+		p.outline = [][2]int{{w / 4, 0}, {w * 3 / 4, 0}, {w, h / 2},
+			{w * 3 / 4, h}, {w / 4, h}, {0, h / 2}}
+		p.approx = func(wx, wy float64) (int, int) {
+			x := int(math.Floor(wx / (fw * 3 / 4)))
+			return x, int(math.Floor((wy - float64(x&1)*fh/2) / fh))
+		}
+		// Odd columns are lower, so are drawn after the even columns of
+		// the same row
+		p.order = func(mw, mh int, fn func(x, y int)) {
+			for y := 0; y < mh; y++ {
+				for x := 0; x < mw; x += 2 {
+					fn(x, y)
+				}
+				for x := 1; x < mw; x += 2 {
+					fn(x, y)
+				}
+			}
+		}
+
+	default:
+		p.layout = func(x, y int) (int, int) {
+			return (y - x) * w / 2, (x + y) * h / 2
+		}
+		p.outline = [][2]int{{w / 2, 0}, {w, h / 2}, {w / 2, h}, {0, h / 2}}
+		p.local, p.unlocal = diamondLocal(fw, fh)
+		p.approx = func(wx, wy float64) (int, int) {
+			lx, ly := p.unlocal(wx, wy)
+			return int(math.Floor(lx)), int(math.Floor(ly))
+		}
+		// Walk the diagonals, back to front
+		p.order = func(mw, mh int, fn func(x, y int)) {
+			for s := 0; s < mw+mh; s++ {
+				for x := 0; x < s; x++ {
+					y := s - x - 1
+					if x >= mw || y < 0 || y >= mh {
+						continue
+					}
+					fn(x, y)
+				}
+			}
+		}
+	}
+	return p
+}
+
+// Maps fractional coordinates within a diamond shaped tile to pixels from the
+// top left of its bounding box, and back
+func diamondLocal(w, h float64) (func(float64, float64) (float64, float64), func(float64, float64) (float64, float64)) {
+	local := func(fx, fy float64) (float64, float64) {
+		return (fy-fx)*w/2 + w/2, (fx + fy) * h / 2
+	}
+	unlocal := func(lx, ly float64) (float64, float64) {
+		a := (lx - w/2) / (w / 2)
+		b := ly / (h / 2)
+		return (b - a) / 2, (a + b) / 2
+	}
+	return local, unlocal
+}
+
+// A projection where every tile has the same outline, and tiles are laid out
+// by a function of their coordinates
+type layoutProjection struct {
+	w, h int
+	// The top left of a tile's bounding box
+	layout  func(x, y int) (int, int)
+	outline [][2]int
+	// Fractional coordinates within a tile to pixels from its origin, and
+	// back
+	local, unlocal func(float64, float64) (float64, float64)
+	// A tile at or next to the one containing a point
+	approx func(wx, wy float64) (int, int)
+	order  func(w, h int, fn func(x, y int))
+}
+
+func (p *layoutProjection) TileOrigin(x, y int) (int, int) {
+	return p.layout(x, y)
+}
+
+func (p *layoutProjection) TileToWorld(tx, ty float64) (float64, float64) {
+	x, y := math.Floor(tx), math.Floor(ty)
+	ox, oy := p.layout(int(x), int(y))
+	lx, ly := p.local(tx-x, ty-y)
+	return float64(ox) + lx, float64(oy) + ly
+}
+
+func (p *layoutProjection) WorldToTile(wx, wy float64) (float64, float64) {
+	ax, ay := p.approx(wx, wy)
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			ox, oy := p.layout(ax+dx, ay+dy)
+			lx, ly := wx-float64(ox), wy-float64(oy)
+			if insidePolygon(p.outline, lx, ly) {
+				fx, fy := p.unlocal(lx, ly)
+				return float64(ax+dx) + clampFraction(fx), float64(ay+dy) + clampFraction(fy)
+			}
+		}
+	}
+	// Between tiles, e.g. on an edge. Near enough.
+	ox, oy := p.layout(ax, ay)
+	fx, fy := p.unlocal(wx-float64(ox), wy-float64(oy))
+	return float64(ax) + fx, float64(ay) + fy
+}
+
+func (p *layoutProjection) TileOutline() [][2]int {
+	return p.outline
+}
+
+func (p *layoutProjection) DrawOrder(w, h int, fn func(x, y int)) {
+	p.order(w, h, fn)
+}
+
+// Keeps a fraction within a tile, so rounding doesn't move it to the next one
+func clampFraction(f float64) float64 {
+	return math.Max(0, math.Min(f, math.Nextafter(1, 0)))
+}
+
+// Whether the point is inside the polygon, by counting crossings of a ray
+// going right from it
+func insidePolygon(poly [][2]int, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		xi, yi := float64(poly[i][0]), float64(poly[i][1])
+		xj, yj := float64(poly[j][0]), float64(poly[j][1])
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
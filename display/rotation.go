@@ -0,0 +1,94 @@
+package display
+
+import (
+	"log"
+)
+
+// Optionally implemented by a GameEngine that wants to know when the view is
+// rotated, e.g. to return sprites facing the right way from GetTile.
+type RotationListener interface {
+	// Called with the new rotation, from 0 to 3 quarter turns clockwise
+	RotationChanged(rotation int)
+}
+
+// The dimensions of the map in tiles, as seen with the rotation
+func viewDimensions(rotation int, config DisplayConfig) (int, int) {
+	if rotation%2 == 1 {
+		return config.MapH, config.MapW
+	}
+	return config.MapW, config.MapH
+}
+
+// Converts a tile on the map to where it appears with the rotation
+func rotateTile(x, y, rotation int, config DisplayConfig) (int, int) {
+	switch rotation {
+	case 1:
+		return config.MapH - 1 - y, x
+	case 2:
+		return config.MapW - 1 - x, config.MapH - 1 - y
+	case 3:
+		return y, config.MapW - 1 - x
+	}
+	return x, y
+}
+
+// The inverse of rotateTile
+func unrotateTile(vx, vy, rotation int, config DisplayConfig) (int, int) {
+	switch rotation {
+	case 1:
+		return vy, config.MapH - 1 - vx
+	case 2:
+		return config.MapW - 1 - vx, config.MapH - 1 - vy
+	case 3:
+		return config.MapW - 1 - vy, vx
+	}
+	return vx, vy
+}
+
+// Like rotateTile, for a point in tile coordinates rather than a whole tile
+func rotatePoint(tx, ty float64, rotation int, config DisplayConfig) (float64, float64) {
+	w, h := float64(config.MapW), float64(config.MapH)
+	switch rotation {
+	case 1:
+		return h - ty, tx
+	case 2:
+		return w - tx, h - ty
+	case 3:
+		return ty, w - tx
+	}
+	return tx, ty
+}
+
+// The inverse of rotatePoint
+func unrotatePoint(vx, vy float64, rotation int, config DisplayConfig) (float64, float64) {
+	w, h := float64(config.MapW), float64(config.MapH)
+	switch rotation {
+	case 1:
+		return vy, h - vx
+	case 2:
+		return w - vx, h - vy
+	case 3:
+		return w - vy, vx
+	}
+	return vx, vy
+}
+
+// Rotates the view to the given number of quarter turns clockwise, keeping
+// the same tile in the centre of the screen, and tells the GameEngine if it is
+// a RotationListener. Staggered and hex maps can't be rotated, so stay as they
+// are.
+func (d *DisplayEngine) SetRotation(rotation int) {
+	d.drawLock.Lock()
+	if !d.viewport.SetRotation(rotation, d.config) {
+		d.drawLock.Unlock()
+		log.Printf("Can't rotate the view with projection %v", d.config.Projection)
+		return
+	}
+	rotation = d.viewport.rotation
+	d.drawLock.Unlock()
+
+	d.InvalidateMinimap()
+	if listener, ok := (*d.gameEngine).(RotationListener); ok {
+		listener.RotationChanged(rotation)
+	}
+}
@@ -0,0 +1,240 @@
+package display
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bluepeppers/allegro"
+)
+
+type TextAlign int
+
+const (
+	ALIGN_LEFT TextAlign = iota
+	ALIGN_CENTRE
+	ALIGN_RIGHT
+)
+
+// Something text can be drawn with. Either a resources.GlyphFont, or an
+// allegro font wrapped in bitmapFont.
+type textFont interface {
+	GetTextWidth(string) int
+	GetLineHeight() int
+	Draw(allegro.Color, float32, float32, string)
+}
+
+// Adapts allegro's bitmap and builtin fonts to textFont
+type bitmapFont struct {
+	*allegro.Font
+}
+
+func (f bitmapFont) Draw(color allegro.Color, x, y float32, text string) {
+	f.Font.Draw(color, x, y, 0, text)
+}
+
+// How a piece of text should be drawn
+type TextStyle struct {
+	// The name of a font from resources.ini. Leave empty to use the builtin
+	// font.
+	Font  string
+	Color allegro.Color
+	// Which side of the label's position the text is aligned to
+	Align TextAlign
+	// The width in pixels at which to wrap lines. 0 to never wrap.
+	WrapWidth int
+
+	Shadow           bool
+	ShadowColor      allegro.Color
+	ShadowX, ShadowY int
+}
+
+// White, left aligned text in the builtin font, with no shadow
+func DefaultTextStyle() TextStyle {
+	return TextStyle{
+		Color:       allegro.CreateColor(255, 255, 255, 255),
+		ShadowColor: allegro.CreateColor(0, 0, 0, 192),
+		ShadowX:     1,
+		ShadowY:     1,
+	}
+}
+
+// A piece of text drawn every frame until removed. Either in screen
+// coordinates, or anchored to a point on the map given in tile coordinates.
+type Label struct {
+	text   string
+	style  TextStyle
+	x, y   float64
+	onTile bool
+}
+
+// Adds a label at the given screen coordinates
+func (d *DisplayEngine) AddScreenLabel(x, y int, text string, style TextStyle) *Label {
+	l := &Label{text: text, style: style, x: float64(x), y: float64(y)}
+	d.textLock.Lock()
+	d.labels = append(d.labels, l)
+	d.textLock.Unlock()
+	return l
+}
+
+// Adds a label that follows the given point on the map as the viewport moves.
+// The centre of tile (x, y) is at (x+0.5, y+0.5).
+func (d *DisplayEngine) AddTileLabel(tx, ty float64, text string, style TextStyle) *Label {
+	l := &Label{text: text, style: style, x: tx, y: ty, onTile: true}
+	d.textLock.Lock()
+	d.labels = append(d.labels, l)
+	d.textLock.Unlock()
+	return l
+}
+
+func (d *DisplayEngine) SetLabelText(l *Label, text string) {
+	d.textLock.Lock()
+	l.text = text
+	d.textLock.Unlock()
+}
+
+func (d *DisplayEngine) SetLabelStyle(l *Label, style TextStyle) {
+	d.textLock.Lock()
+	l.style = style
+	d.textLock.Unlock()
+}
+
+// Moves the label. The coordinates are in tiles for tile labels, and pixels
+// for screen labels.
+func (d *DisplayEngine) MoveLabel(l *Label, x, y float64) {
+	d.textLock.Lock()
+	l.x, l.y = x, y
+	d.textLock.Unlock()
+}
+
+func (d *DisplayEngine) RemoveLabel(l *Label) {
+	d.textLock.Lock()
+	defer d.textLock.Unlock()
+	for i, other := range d.labels {
+		if other == l {
+			d.labels = append(d.labels[:i], d.labels[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the size in pixels the text would take up if drawn in the style,
+// after wrapping
+func (d *DisplayEngine) MeasureText(text string, style TextStyle) (int, int) {
+	font := d.getFont(style.Font)
+	lines := wrapText(font, text, style.WrapWidth)
+	w := 0
+	for _, line := range lines {
+		if lw := font.GetTextWidth(line); lw > w {
+			w = lw
+		}
+	}
+	return w, len(lines) * font.GetLineHeight()
+}
+
+// Returns the named font, or the builtin font if there is no such font.
+// TrueType fonts are drawn from the glyph atlas, so they can handle any text.
+func (d *DisplayEngine) getFont(name string) textFont {
+	if name == "" {
+		return bitmapFont{d.builtinFont}
+	}
+	if font, ok := d.resourceManager.GetGlyphFont(name); ok {
+		return font
+	}
+	font, ok := d.resourceManager.GetFont(name)
+	if !ok {
+		d.textLock.Lock()
+		if !d.missingFonts[name] {
+			log.Printf("Could not find font named %q. Defaulting to builtin font.", name)
+			d.missingFonts[name] = true
+		}
+		d.textLock.Unlock()
+		return bitmapFont{d.builtinFont}
+	}
+	return bitmapFont{font}
+}
+
+// Draws the text at the given screen coordinates. The current transform must
+// be the identity.
+func (d *DisplayEngine) drawText(x, y float64, text string, style TextStyle) {
+	font := d.getFont(style.Font)
+	lineHeight := float32(font.GetLineHeight())
+	for i, line := range wrapText(font, text, style.WrapWidth) {
+		lx := float32(x)
+		switch style.Align {
+		case ALIGN_CENTRE:
+			lx -= float32(font.GetTextWidth(line)) / 2
+		case ALIGN_RIGHT:
+			lx -= float32(font.GetTextWidth(line))
+		}
+		ly := float32(y) + float32(i)*lineHeight
+
+		if style.Shadow {
+			font.Draw(style.ShadowColor, lx+float32(style.ShadowX),
+				ly+float32(style.ShadowY), line)
+		}
+		font.Draw(style.Color, lx, ly, line)
+	}
+}
+
+func (d *DisplayEngine) drawLabels(viewport Viewport) {
+	d.textLock.Lock()
+	labels := make([]Label, len(d.labels))
+	for i, l := range d.labels {
+		labels[i] = *l
+	}
+	d.textLock.Unlock()
+
+	for _, l := range labels {
+		x, y := l.x, l.y
+		if l.onTile {
+			x, y = viewport.WorldToScreen(viewport.TileToWorld(l.x, l.y, d.config))
+		}
+		d.drawText(x, y, l.text, l.style)
+	}
+}
+
+// Splits the text into lines no wider than width, breaking at spaces where
+// possible, and between characters in words too wide for a line of their own,
+// as in scripts written without spaces. Explicit newlines are always honoured.
+func wrapText(font textFont, text string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		if width <= 0 {
+			lines = append(lines, para)
+			continue
+		}
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if line != "" && font.GetTextWidth(line+" "+word) <= width {
+				line += " " + word
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			for utf8.RuneCountInString(word) > 1 && font.GetTextWidth(word) > width {
+				n := fitRunes(font, word, width)
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// The length in bytes of the longest start of the word no wider than width,
+// which is at least its first rune
+func fitRunes(font textFont, word string, width int) int {
+	n := 0
+	for i, r := range word {
+		end := i + utf8.RuneLen(r)
+		if n > 0 && font.GetTextWidth(word[:end]) > width {
+			break
+		}
+		n = end
+	}
+	return n
+}
@@ -0,0 +1,40 @@
+package display
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bluepeppers/allegro"
+)
+
+// Every rune is 10 pixels wide
+type fixedFont struct{}
+
+func (fixedFont) GetTextWidth(text string) int                 { return 10 * utf8.RuneCountInString(text) }
+func (fixedFont) GetLineHeight() int                           { return 10 }
+func (fixedFont) Draw(allegro.Color, float32, float32, string) {}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+		want  []string
+	}{
+		{"the cat sat", 70, []string{"the cat", "sat"}},
+		{"one\ntwo three", 200, []string{"one", "two three"}},
+		{"unwrapped text", 0, []string{"unwrapped text"}},
+		// No spaces to break at
+		{"日本語のテキスト", 30, []string{"日本語", "のテキ", "スト"}},
+		// A word too wide for a line of its own
+		{"a abcdefgh b", 40, []string{"a", "abcd", "efgh", "b"}},
+		// Narrower than any one rune
+		{"ab", 5, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		got := wrapText(fixedFont{}, test.text, test.width)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrapText(%q, %v) = %q, want %q", test.text, test.width, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package display
+
+import (
+	"sync"
+
+	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+
+	"github.com/bluepeppers/danckelmann/resources"
+)
+
+// How a widget is drawn. The bitmap, if any, is stretched over the widget and
+// tinted by Color; otherwise the widget is filled with Color.
+type UISkin struct {
+	// The name of a tile from the ResourceManager. Leave empty for a flat
+	// colour.
+	Bitmap string
+	Color  allegro.Color
+	Text   TextStyle
+}
+
+type UITheme struct {
+	Panel                              UISkin
+	Button, ButtonHover, ButtonPressed UISkin
+	List, ListHover, ListSelected      UISkin
+	Tooltip                            UISkin
+	// Space in pixels between a widget's edge and its contents
+	Padding int
+}
+
+// Flat grey widgets with white text
+func DefaultUITheme() UITheme {
+	text := DefaultTextStyle()
+	centred := text
+	centred.Align = ALIGN_CENTRE
+	dark := DefaultTextStyle()
+	dark.Color = allegro.CreateColor(0, 0, 0, 255)
+	return UITheme{
+		Panel:         UISkin{Color: allegro.CreateColor(32, 32, 32, 224), Text: text},
+		Button:        UISkin{Color: allegro.CreateColor(64, 64, 64, 255), Text: centred},
+		ButtonHover:   UISkin{Color: allegro.CreateColor(96, 96, 96, 255), Text: centred},
+		ButtonPressed: UISkin{Color: allegro.CreateColor(48, 48, 48, 255), Text: centred},
+		List:          UISkin{Color: allegro.CreateColor(24, 24, 24, 255), Text: text},
+		ListHover:     UISkin{Color: allegro.CreateColor(56, 56, 56, 255), Text: text},
+		ListSelected:  UISkin{Color: allegro.CreateColor(40, 72, 120, 255), Text: text},
+		Tooltip:       UISkin{Color: allegro.CreateColor(255, 255, 208, 240), Text: dark},
+		Padding:       4,
+	}
+}
+
+// Builds the UI for a frame by calling widget methods. Set with
+// DisplayEngine.SetUI, and called once per frame after the map is drawn.
+type UIFunc func(ui *UI)
+
+type rect struct {
+	x, y, w, h int
+}
+
+func (r rect) contains(x, y int) bool {
+	return x >= r.x && x < r.x+r.w && y >= r.y && y < r.y+r.h
+}
+
+// Immediate mode UI, drawn in screen coordinates over the map. Widgets are
+// identified by a string id that must be unique and stable between frames.
+type UI struct {
+	d     *DisplayEngine
+	Theme UITheme
+
+	// Mouse and keyboard input. Guarded by inputLock, as it is written by
+	// the event handler.
+	inputLock        sync.Mutex
+	mouseX, mouseY   int
+	mouseDown        bool
+	pressed, clicked bool
+	wheel            int
+	keys             []int
+	text             []rune
+
+	// Snapshot of the input for the frame being built
+	frameX, frameY int
+	framePressed   bool
+	frameClicked   bool
+	frameDown      bool
+	frameWheel     int
+	frameKeys      []int
+	frameText      string
+
+	// The widget the mouse button went down on, if it's still held, and for
+	// lists, the row
+	active    string
+	activeRow int
+	// Whether the last widget drawn was under the mouse
+	lastHovered bool
+	tooltip     string
+
+	scroll map[string]int
+
+	// Areas covered by widgets last frame, which capture the mouse
+	hitLock  sync.Mutex
+	hitRects []rect
+	building []rect
+}
+
+func createUI(d *DisplayEngine) *UI {
+	return &UI{d: d, Theme: DefaultUITheme(), scroll: make(map[string]int)}
+}
+
+// Sets the function that builds the UI every frame. nil removes the UI.
+func (d *DisplayEngine) SetUI(fn UIFunc) {
+	d.uiLock.Lock()
+	d.uiFunc = fn
+	d.uiLock.Unlock()
+}
+
+func (d *DisplayEngine) GetUI() *UI {
+	return d.ui
+}
+
+// Whether the point is covered by a widget, in which case mouse input there
+// goes to the UI rather than the map
+func (ui *UI) capturesMouse(x, y int) bool {
+	ui.hitLock.Lock()
+	defer ui.hitLock.Unlock()
+	for _, r := range ui.hitRects {
+		if r.contains(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ui *UI) mouseMoved(x, y, dz int) {
+	ui.inputLock.Lock()
+	ui.mouseX, ui.mouseY = x, y
+	ui.wheel += dz
+	ui.inputLock.Unlock()
+}
+
+func (ui *UI) mouseButton(x, y int, down bool) {
+	ui.inputLock.Lock()
+	ui.mouseX, ui.mouseY = x, y
+	if down {
+		ui.pressed = true
+	} else if ui.mouseDown {
+		ui.clicked = true
+	}
+	ui.mouseDown = down
+	ui.inputLock.Unlock()
+}
+
+// Records a key press, repeated while the key is held. r is the character
+// typed, or 0 if the key doesn't type one.
+func (ui *UI) keyTyped(keycode int, r rune) {
+	ui.inputLock.Lock()
+	ui.keys = append(ui.keys, keycode)
+	if r >= ' ' && r != 127 {
+		ui.text = append(ui.text, r)
+	}
+	ui.inputLock.Unlock()
+}
+
+func (ui *UI) begin() {
+	ui.inputLock.Lock()
+	ui.frameX, ui.frameY = ui.mouseX, ui.mouseY
+	ui.framePressed, ui.frameClicked = ui.pressed, ui.clicked
+	ui.frameDown = ui.mouseDown
+	ui.frameWheel = ui.wheel
+	ui.frameKeys, ui.frameText = ui.keys, string(ui.text)
+	ui.pressed, ui.clicked = false, false
+	ui.wheel = 0
+	ui.keys, ui.text = nil, nil
+	ui.inputLock.Unlock()
+
+	ui.building = ui.building[:0]
+	ui.tooltip = ""
+	ui.lastHovered = false
+}
+
+func (ui *UI) end() {
+	if ui.tooltip != "" {
+		skin := ui.Theme.Tooltip
+		w, h := ui.d.MeasureText(ui.tooltip, skin.Text)
+		p := ui.Theme.Padding
+		x, y := ui.frameX+16, ui.frameY+16
+		ui.d.drawRect(rect{x, y, w + 2*p, h + 2*p}, skin)
+		ui.d.drawText(float64(x+p), float64(y+p), ui.tooltip, skin.Text)
+	}
+	if !ui.frameDown {
+		ui.active = ""
+	}
+
+	ui.hitLock.Lock()
+	ui.hitRects = append(ui.hitRects[:0], ui.building...)
+	ui.hitLock.Unlock()
+}
+
+// Records the widget's area, and returns whether the mouse is over it
+func (ui *UI) widget(r rect) bool {
+	ui.building = append(ui.building, r)
+	ui.lastHovered = r.contains(ui.frameX, ui.frameY)
+	return ui.lastHovered
+}
+
+// Whether the key was pressed since the last frame, including repeats while
+// it is held. keycode is one of allegro's KEY_ constants.
+func (ui *UI) KeyPressed(keycode int) bool {
+	for _, k := range ui.frameKeys {
+		if k == keycode {
+			return true
+		}
+	}
+	return false
+}
+
+// The text typed since the last frame, without control characters such as
+// backspace or enter; check those with KeyPressed
+func (ui *UI) TypedText() string {
+	return ui.frameText
+}
+
+// Draws a panel. Widgets drawn after it appear on top.
+func (ui *UI) Panel(x, y, w, h int) {
+	r := rect{x, y, w, h}
+	ui.widget(r)
+	ui.d.drawRect(r, ui.Theme.Panel)
+}
+
+// Draws text, wrapped to the given width if the style asks for it. Labels
+// don't capture the mouse, so clicks on them go through to whatever is below.
+func (ui *UI) Label(x, y int, text string, style TextStyle) {
+	w, h := ui.d.MeasureText(text, style)
+	lx := x
+	switch style.Align {
+	case ALIGN_CENTRE:
+		lx -= w / 2
+	case ALIGN_RIGHT:
+		lx -= w
+	}
+	ui.lastHovered = rect{lx, y, w, h}.contains(ui.frameX, ui.frameY)
+	ui.d.drawText(float64(x), float64(y), text, style)
+}
+
+// Draws a button, returning true on the frame it is clicked
+func (ui *UI) Button(id string, x, y, w, h int, text string) bool {
+	r := rect{x, y, w, h}
+	hovered := ui.widget(r)
+	if hovered && ui.framePressed {
+		ui.active = id
+	}
+	clicked := hovered && ui.frameClicked && ui.active == id
+
+	skin := ui.Theme.Button
+	if ui.active == id && ui.frameDown {
+		skin = ui.Theme.ButtonPressed
+	} else if hovered {
+		skin = ui.Theme.ButtonHover
+	}
+	ui.d.drawRect(r, skin)
+	_, th := ui.d.MeasureText(text, skin.Text)
+	ui.d.drawText(float64(x+w/2), float64(y+(h-th)/2), text, skin.Text)
+	return clicked
+}
+
+// Draws a scrollable list of items, scrolled with the mouse wheel. Returns
+// the index of the selected item, which is the item clicked this frame, or
+// selected otherwise.
+func (ui *UI) List(id string, x, y, w, h int, items []string, selected int) int {
+	r := rect{x, y, w, h}
+	hovered := ui.widget(r)
+	ui.d.drawRect(r, ui.Theme.List)
+
+	p := ui.Theme.Padding
+	_, lineHeight := ui.d.MeasureText("", ui.Theme.List.Text)
+	rowHeight := lineHeight + 2*p
+
+	maxScroll := len(items)*rowHeight - h
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	scroll := ui.scroll[id]
+	if hovered {
+		scroll -= ui.frameWheel * rowHeight
+	}
+	if scroll > maxScroll {
+		scroll = maxScroll
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	ui.scroll[id] = scroll
+
+	ui.d.setClip(&r)
+	for i, item := range items {
+		row := rect{x, y + i*rowHeight - scroll, w, rowHeight}
+		if row.y+row.h < y || row.y > y+h {
+			continue
+		}
+		rowHovered := hovered && row.contains(ui.frameX, ui.frameY)
+		if rowHovered && ui.framePressed {
+			ui.active, ui.activeRow = id, i
+		}
+		// Only rows the button went down and came up on are selected
+		if rowHovered && ui.frameClicked && ui.active == id && ui.activeRow == i {
+			selected = i
+		}
+
+		skin := ui.Theme.List
+		if i == selected {
+			skin = ui.Theme.ListSelected
+		} else if rowHovered {
+			skin = ui.Theme.ListHover
+		}
+		ui.d.drawRect(row, skin)
+		ui.d.drawText(float64(row.x+p), float64(row.y+p), item, skin.Text)
+	}
+	ui.d.setClip(nil)
+
+	ui.lastHovered = hovered
+	return selected
+}
+
+// Shows the text by the cursor if the mouse is over the last widget drawn
+func (ui *UI) Tooltip(text string) {
+	if ui.lastHovered {
+		ui.tooltip = text
+	}
+}
+
+// Draws the UI built by the UIFunc, if there is one. The current transform
+// must be the identity.
+func (d *DisplayEngine) drawUI() {
+	d.uiLock.Lock()
+	fn := d.uiFunc
+	d.uiLock.Unlock()
+	if fn == nil {
+		d.ui.hitLock.Lock()
+		d.ui.hitRects = nil
+		d.ui.hitLock.Unlock()
+		return
+	}
+
+	d.ui.begin()
+	fn(d.ui)
+	d.ui.end()
+}
+
+// Fills the rectangle in screen coordinates with the skin
+func (d *DisplayEngine) drawRect(r rect, skin UISkin) {
+	var tex gl.Texture
+	textured := false
+	if skin.Bitmap != "" {
+		bmp := d.resourceManager.GetTileOrDefault(skin.Bitmap)
+		// The UI is always on screen, so is loaded before the map
+		d.resourceManager.PrioritizeTile(bmp, 0)
+		d.resourceManager.MarkDrawn(bmp)
+		tex, textured = bmp.Texture(), true
+	}
+
+	allegro.RunInThread(func() {
+		resources.WithScreenProjection(func() {
+			gl.Enable(gl.BLEND)
+			// Skin bitmaps are premultiplied like every tile
+			setBlendMode(BLEND_ALPHA)
+			if textured {
+				gl.Enable(gl.TEXTURE_2D)
+				tex.Bind(gl.TEXTURE_2D)
+			} else {
+				gl.Disable(gl.TEXTURE_2D)
+			}
+			setGLColor(skin.Color)
+			gl.Begin(gl.QUADS)
+			gl.TexCoord2f(0, 0); gl.Vertex2i(r.x, r.y)
+			gl.TexCoord2f(0, 1); gl.Vertex2i(r.x, r.y+r.h)
+			gl.TexCoord2f(1, 1); gl.Vertex2i(r.x+r.w, r.y+r.h)
+			gl.TexCoord2f(1, 0); gl.Vertex2i(r.x+r.w, r.y)
+			gl.End()
+			gl.Color4f(1, 1, 1, 1)
+			gl.Enable(gl.TEXTURE_2D)
+		})
+	})
+}
+
+// Restricts drawing to the rectangle in screen coordinates, or removes the
+// restriction if r is nil
+func (d *DisplayEngine) setClip(r *rect) {
+	allegro.RunInThread(func() {
+		if r == nil {
+			gl.Disable(gl.SCISSOR_TEST)
+			return
+		}
+		var viewport [4]int32
+		gl.GetIntegerv(gl.VIEWPORT, viewport[:])
+		gl.Enable(gl.SCISSOR_TEST)
+		// GL's origin is the bottom left
+		gl.Scissor(r.x, int(viewport[3])-r.y-r.h, r.w, r.h)
+	})
+}
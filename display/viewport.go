@@ -13,6 +13,8 @@ var ISOMETRIC_ROTATION = float32(3 * math.Pi / 8)
 type Viewport struct {
 	x, y, w, h int
 	xZoom, yZoom float64
+	// Quarter turns clockwise, from 0 to 3
+	rotation int
 
 	trans allegro.Transform
 }
@@ -39,6 +41,29 @@ func (v *Viewport) Move(dx, dy int) {
 	v.y += dy
 }
 
+func (v *Viewport) GetRotation() int {
+	return v.rotation
+}
+
+// Rotates the view to the given number of quarter turns clockwise, keeping
+// the tile at the centre of the viewport in the centre. Use
+// DisplayEngine.SetRotation to have the GameEngine told about it. Returns
+// false, leaving the view as it was, if the config's projection can't be
+// rotated.
+func (v *Viewport) SetRotation(rotation int, config DisplayConfig) bool {
+	rotation = ((rotation % 4) + 4) % 4
+	if rotation != 0 && !config.rotatable() {
+		return false
+	}
+	tx, ty := v.ScreenCoordinatesToTile(v.w/2, v.h/2, config)
+	v.rotation = rotation
+	cx, cy := v.TileToWorld(tx, ty, config)
+	v.x = int(cx - float64(v.w)*v.xZoom/2)
+	v.y = int(cy - float64(v.h)*v.yZoom/2)
+	v.buildTrans()
+	return true
+}
+
 func (v *Viewport) GetTransform() *allegro.Transform {
 	return &v.trans
 }
@@ -67,6 +92,31 @@ func (v *Viewport) OnScreen(x, y, w, h int) bool {
         y > v.y + int(float64(v.h) * v.yZoom))
 }
 
+// The distance in pixels from the point to the centre of the viewport
+func (v *Viewport) DistanceFromCentre(x, y int) float64 {
+	cx := float64(v.x) + float64(v.w)*v.xZoom/2
+	cy := float64(v.y) + float64(v.h)*v.yZoom/2
+	return math.Hypot(float64(x)-cx, float64(y)-cy)
+}
+
+// Converts pixel coordinates on the map to coordinates on the screen
+func (v *Viewport) WorldToScreen(x, y float64) (float64, float64) {
+	return (x - float64(v.x)) / v.xZoom, (y - float64(v.y)) / v.yZoom
+}
+
+// Converts a point in tile coordinates to pixel coordinates on the map, with
+// the viewport's rotation and the config's projection. Tile (x, y) covers
+// [x, x+1) by [y, y+1), so its centre is at (x+0.5, y+0.5).
+func (v *Viewport) TileToWorld(tx, ty float64, config DisplayConfig) (float64, float64) {
+	vx, vy := rotatePoint(tx, ty, v.rotation, config)
+	return config.GetProjection().TileToWorld(vx, vy)
+}
+
+// Converts coordinates on the screen to pixel coordinates on the map
+func (v *Viewport) ScreenToWorld(sx, sy float64) (float64, float64) {
+	return sx*v.xZoom + float64(v.x), sy*v.yZoom + float64(v.y)
+}
+
 func (v *Viewport) TileCoordinatesToScreen(tx, ty float64, config DisplayConfig) (float64, float64) {
 	var trans allegro.Transform
 	trans.Build(float32(-v.x), float32(-v.y), float32(v.xZoom), float32(v.yZoom),
@@ -75,23 +125,39 @@ func (v *Viewport) TileCoordinatesToScreen(tx, ty float64, config DisplayConfig)
 	return float64(x), float64(y)
 }
 
+// Returns the tile coordinates of the tile drawn at the point on the screen.
+// If the config has Heights, tiles are lifted by them; where several raised
+// tiles overlap, the one in front wins.
 func (v *Viewport) ScreenCoordinatesToTile(sx, sy int, config DisplayConfig) (float64, float64) {
-	// I have never been more ashamed of code I have written
-	w, h := float64(config.TileW), float64(config.TileH)
-	fx, fy := float32(sx), float32(sy)
-	var trans allegro.Transform
-	trans.Identity()
-	// Builds the viewport alignment matrix
-	trans.Build(float32(-v.x), float32(-v.y), float32(v.xZoom), float32(v.yZoom),
-		0)
-	// Invert it to get back to pixel coordinates
-	trans.Invert()
-	// We need to translate back half a width to get to the pivot of the tiles
-	trans.Translate(-float32(w/2), 0)
-
-	x, y := trans.Apply(fx, fy)
-	// Then we manually rotate it (because I'm bad at maths I guess)
-	tx := float64(float64(y) * w - float64(x) * h) / (w * h)
-	ty := float64(float64(y) * w + float64(x) * h) / (w * h)
-	return tx, ty
-}
\ No newline at end of file
+	heights := config.Heights
+	if heights == nil || config.HeightStep == 0 {
+		return v.flatScreenToTile(sx, sy, config)
+	}
+
+	projection := config.GetProjection()
+	bestX, bestY := v.flatScreenToTile(sx, sy, config)
+	// Tiles lower down the screen are drawn in front
+	bestDepth := math.MinInt32
+	for h := 0; h <= config.MaxHeight; h++ {
+		// Where the point would be if the tiles at this height were flat
+		lift := float64(h*config.HeightStep) / v.yZoom
+		tx, ty := v.flatScreenToTile(sx, sy+int(lift), config)
+		x, y := int(math.Floor(tx)), int(math.Floor(ty))
+		if x < 0 || x >= config.MapW || y < 0 || y >= config.MapH {
+			continue
+		}
+		_, depth := projection.TileOrigin(rotateTile(x, y, v.rotation, config))
+		if heights.GetHeight(x, y) == h && depth > bestDepth {
+			bestX, bestY, bestDepth = tx, ty, depth
+		}
+	}
+	return bestX, bestY
+}
+
+// The tile coordinates of the point on the screen, as if every tile were at
+// height 0
+func (v *Viewport) flatScreenToTile(sx, sy int, config DisplayConfig) (float64, float64) {
+	wx, wy := v.ScreenToWorld(float64(sx), float64(sy))
+	tx, ty := config.GetProjection().WorldToTile(wx, wy)
+	return unrotatePoint(tx, ty, v.rotation, config)
+}
@@ -0,0 +1,321 @@
+package resources
+
+import (
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Dimensions of each texture in the glyph atlas
+	ATLAS_PAGE_SIZE = 1024
+	// Gap left around each glyph, so that filtering doesn't bleed
+	ATLAS_PADDING = 1
+)
+
+// A texture that glyphs are packed into, in rows
+type atlasPage struct {
+	tex     gl.Texture
+	created bool
+	dirty   bool
+	pixels  *image.Alpha
+
+	// The row currently being filled
+	rowX, rowY, rowH int
+}
+
+// Glyphs from every font, rasterized on demand and packed into shared
+// textures
+type glyphAtlas struct {
+	lock  sync.Mutex
+	pages []*atlasPage
+}
+
+// Copies the glyph into the atlas, returning the page and the area it was
+// placed in. Returns -1 if the glyph is too big to ever fit.
+func (a *glyphAtlas) add(mask *image.Alpha) (int, image.Rectangle) {
+	w, h := mask.Bounds().Dx(), mask.Bounds().Dy()
+	if w+ATLAS_PADDING > ATLAS_PAGE_SIZE || h+ATLAS_PADDING > ATLAS_PAGE_SIZE {
+		return -1, image.ZR
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var page *atlasPage
+	if len(a.pages) > 0 {
+		page = a.pages[len(a.pages)-1]
+		if page.rowX+w+ATLAS_PADDING > ATLAS_PAGE_SIZE {
+			page.rowX = 0
+			page.rowY += page.rowH
+			page.rowH = 0
+		}
+		if page.rowY+h+ATLAS_PADDING > ATLAS_PAGE_SIZE {
+			page = nil
+		}
+	}
+	if page == nil {
+		page = &atlasPage{pixels: image.NewAlpha(image.Rect(0, 0, ATLAS_PAGE_SIZE, ATLAS_PAGE_SIZE))}
+		a.pages = append(a.pages, page)
+	}
+
+	rect := image.Rect(page.rowX, page.rowY, page.rowX+w, page.rowY+h)
+	draw.Draw(page.pixels, rect, mask, mask.Bounds().Min, draw.Src)
+	page.dirty = true
+	page.rowX += w + ATLAS_PADDING
+	if h+ATLAS_PADDING > page.rowH {
+		page.rowH = h + ATLAS_PADDING
+	}
+	return len(a.pages) - 1, rect
+}
+
+// Uploads any pages with new glyphs, and returns the page textures. Must be
+// called on the render thread.
+func (a *glyphAtlas) sync() []gl.Texture {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	texs := make([]gl.Texture, len(a.pages))
+	for i, page := range a.pages {
+		if !page.created {
+			page.tex = gl.GenTexture()
+			page.tex.Bind(gl.TEXTURE_2D)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+			gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+			page.created = true
+			page.dirty = true
+		}
+		if page.dirty {
+			page.tex.Bind(gl.TEXTURE_2D)
+			gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+			gl.TexImage2D(gl.TEXTURE_2D, 0, gl.ALPHA, ATLAS_PAGE_SIZE, ATLAS_PAGE_SIZE,
+				0, gl.ALPHA, gl.UNSIGNED_BYTE, page.pixels.Pix)
+			gl.PixelStorei(gl.UNPACK_ALIGNMENT, 4)
+			page.dirty = false
+		}
+		texs[i] = page.tex
+	}
+	return texs
+}
+
+// Deletes the page textures. Must be called on the render thread.
+func (a *glyphAtlas) free() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, page := range a.pages {
+		if page.created {
+			page.tex.Delete()
+			page.created = false
+		}
+	}
+	a.pages = nil
+}
+
+// Forgets the page textures without deleting them, so they are created and
+// uploaded again on the next sync
+func (a *glyphAtlas) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, page := range a.pages {
+		page.created = false
+	}
+}
+
+// A glyph that has been placed in the atlas
+type glyph struct {
+	// Index of the face in the font's fallback chain that supplied the glyph
+	face int
+	// The atlas page, or -1 if there is nothing to draw (e.g. spaces)
+	page int
+	rect image.Rectangle
+	// From the pen position on the baseline to the top left of the glyph
+	offset  image.Point
+	advance fixed.Int26_6
+}
+
+// A TrueType font drawn from the glyph atlas. Handles any UTF-8 text, using the
+// fallback fonts listed in resources.ini for glyphs the font lacks.
+//
+// Safe for concurrent use.
+type GlyphFont struct {
+	// The primary font, then its fallbacks in order
+	fonts []*truetype.Font
+	faces []font.Face
+	atlas *glyphAtlas
+
+	lock   sync.Mutex
+	glyphs map[rune]glyph
+
+	ascent, lineHeight int
+}
+
+// Parses a TrueType font file
+func loadTrueType(filename string) (*truetype.Font, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return truetype.Parse(data)
+}
+
+func createGlyphFont(fonts []*truetype.Font, size int, atlas *glyphAtlas) *GlyphFont {
+	f := &GlyphFont{fonts: fonts, atlas: atlas, glyphs: make(map[rune]glyph)}
+	for _, ttf := range fonts {
+		f.faces = append(f.faces, truetype.NewFace(ttf, &truetype.Options{
+			Size:    float64(size),
+			DPI:     72,
+			Hinting: font.HintingFull,
+		}))
+	}
+	metrics := f.faces[0].Metrics()
+	f.ascent = metrics.Ascent.Ceil()
+	f.lineHeight = metrics.Height.Ceil()
+	return f
+}
+
+// Returns the glyph for the rune, rasterizing it into the atlas if this is the
+// first time it has been used
+func (f *GlyphFont) getGlyph(r rune) glyph {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if g, ok := f.glyphs[r]; ok {
+		return g
+	}
+
+	// Fall back to the primary font's "missing" glyph if nothing has it
+	face := 0
+	for i, ttf := range f.fonts {
+		if ttf.Index(r) != 0 {
+			face = i
+			break
+		}
+	}
+
+	g := glyph{face: face, page: -1}
+	dr, mask, maskp, advance, ok := f.faces[face].Glyph(fixed.Point26_6{}, r)
+	g.advance = advance
+	if ok && !dr.Empty() {
+		alpha := image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy()))
+		draw.Draw(alpha, alpha.Bounds(), mask, maskp, draw.Src)
+		g.page, g.rect = f.atlas.add(alpha)
+		g.offset = dr.Min
+	}
+	f.glyphs[r] = g
+	return g
+}
+
+// The kerning between two runes from the same face. Faces cache glyph indices
+// as they go, so need the lock like getGlyph.
+func (f *GlyphFont) kern(face int, r0, r1 rune) fixed.Int26_6 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.faces[face].Kern(r0, r1)
+}
+
+// Calls fn with each glyph in the text and the pen position to draw it at,
+// applying kerning between glyphs from the same face
+func (f *GlyphFont) layout(text string, fn func(glyph, fixed.Int26_6)) fixed.Int26_6 {
+	var x fixed.Int26_6
+	var prev glyph
+	prevRune := utf8.RuneError
+	for _, r := range text {
+		g := f.getGlyph(r)
+		if prevRune != utf8.RuneError && prev.face == g.face {
+			x += f.kern(g.face, prevRune, r)
+		}
+		if fn != nil {
+			fn(g, x)
+		}
+		x += g.advance
+		prev, prevRune = g, r
+	}
+	return x
+}
+
+// The width in pixels of the text when drawn on one line
+func (f *GlyphFont) GetTextWidth(text string) int {
+	return f.layout(text, nil).Ceil()
+}
+
+func (f *GlyphFont) GetLineHeight() int {
+	return f.lineHeight
+}
+
+// Draws the text with the top left of the line at (x, y) in screen
+// coordinates
+func (f *GlyphFont) Draw(color allegro.Color, x, y float32, text string) {
+	type quad struct {
+		page   int
+		rect   image.Rectangle
+		sx, sy float32
+		sw, sh float32
+	}
+	var quads []quad
+	baseline := y + float32(f.ascent)
+	f.layout(text, func(g glyph, pen fixed.Int26_6) {
+		if g.page < 0 {
+			return
+		}
+		quads = append(quads, quad{g.page, g.rect,
+			x + float32(pen)/64 + float32(g.offset.X),
+			baseline + float32(g.offset.Y),
+			float32(g.rect.Dx()), float32(g.rect.Dy())})
+	})
+	if len(quads) == 0 {
+		return
+	}
+
+	r, g, b, a := color.GetRGBA()
+	allegro.RunInThread(func() {
+		texs := f.atlas.sync()
+		WithScreenProjection(func() {
+			gl.Enable(gl.TEXTURE_2D)
+			gl.Enable(gl.BLEND)
+			gl.BlendFunc(gl.SRC_ALPHA, gl.ONE_MINUS_SRC_ALPHA)
+			gl.Color4f(float32(r)/255, float32(g)/255, float32(b)/255, float32(a)/255)
+			for _, q := range quads {
+				texs[q.page].Bind(gl.TEXTURE_2D)
+				u0 := float32(q.rect.Min.X) / ATLAS_PAGE_SIZE
+				v0 := float32(q.rect.Min.Y) / ATLAS_PAGE_SIZE
+				u1 := float32(q.rect.Max.X) / ATLAS_PAGE_SIZE
+				v1 := float32(q.rect.Max.Y) / ATLAS_PAGE_SIZE
+				gl.Begin(gl.QUADS)
+				gl.TexCoord2f(u0, v0); gl.Vertex2f(q.sx, q.sy)
+				gl.TexCoord2f(u0, v1); gl.Vertex2f(q.sx, q.sy+q.sh)
+				gl.TexCoord2f(u1, v1); gl.Vertex2f(q.sx+q.sw, q.sy+q.sh)
+				gl.TexCoord2f(u1, v0); gl.Vertex2f(q.sx+q.sw, q.sy)
+				gl.End()
+			}
+			gl.Color4f(1, 1, 1, 1)
+		})
+	})
+}
+
+// Sets up GL to draw in screen coordinates, calls fn, then restores the
+// previous projection. Must be called on the render thread.
+func WithScreenProjection(fn func()) {
+	var viewport [4]int32
+	gl.GetIntegerv(gl.VIEWPORT, viewport[:])
+	gl.MatrixMode(gl.PROJECTION)
+	gl.PushMatrix()
+	gl.LoadIdentity()
+	gl.Ortho(0, float64(viewport[2]), float64(viewport[3]), 0, -1, 1)
+	gl.MatrixMode(gl.MODELVIEW)
+	gl.PushMatrix()
+	gl.LoadIdentity()
+
+	fn()
+
+	gl.MatrixMode(gl.MODELVIEW)
+	gl.PopMatrix()
+	gl.MatrixMode(gl.PROJECTION)
+	gl.PopMatrix()
+}
+
@@ -0,0 +1,37 @@
+package resources
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+func TestGlyphFontConcurrentLayout(t *testing.T) {
+	ttf, err := truetype.Parse(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := createGlyphFont([]*truetype.Font{ttf}, 16, &glyphAtlas{})
+	// A and Ł share a slot in the face's index cache, so kerning them
+	// rewrites it every time. Run with -race.
+	text := "AVAŁAŁ To"
+	want := f.GetTextWidth(text)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if got := f.GetTextWidth(text); got != want {
+					t.Errorf("GetTextWidth = %v, want %v", got, want)
+					return
+				}
+				f.GetTextWidth(string(rune('a' + j%26)))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,14 +1,19 @@
 package resources
 
 import (
+	"image"
+	"image/color"
 	"log"
-	_ "sync"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/go-gl/gl"
-	"github.com/go-gl/glfw"
 	"github.com/bluepeppers/allegro"
+	"github.com/go-gl/gl"
+	"github.com/golang/freetype/truetype"
 )
 
 const (
@@ -17,13 +22,76 @@ const (
 	DEFAULT_TILE_HEIGHT = 128
 )
 
-// Our custom super special bitmap class
+// Our custom super special bitmap class. There is one Bitmap per tile, which
+// may be kept for as long as the ResourceManager is open: the tile's texture
+// is swapped in once it has loaded, and swapped back out for the default
+// tile's if it is evicted.
 type Bitmap struct {
-	Tex gl.Texture
+	// The tile this bitmap was requested as
+	name string
+
+	// Guards the fields below it, which are only written with the
+	// ResourceManager's tileLock held as well, so may be read with either
+	lock sync.RWMutex
+	tex  gl.Texture
 	// The offset of the bitmap when drawing
-	OffX, OffY int
+	offX, offY int
 	// Dimensions
-	W, H int
+	w, h int
+	// Whether tex is the tile's own, rather than the default tile's
+	ready bool
+
+	// The frame the bitmap was last drawn in, for eviction
+	lastDrawn uint64
+}
+
+// Returns false if the bitmap is a placeholder for a tile that is still
+// loading, or that has been evicted.
+func (b *Bitmap) Ready() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.ready
+}
+
+// The texture to draw. Only valid until the end of the frame, so must not be
+// kept.
+func (b *Bitmap) Texture() gl.Texture {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.tex
+}
+
+// The offset of the bitmap when drawing
+func (b *Bitmap) Offset() (int, int) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.offX, b.offY
+}
+
+func (b *Bitmap) Size() (int, int) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.w, b.h
+}
+
+// The name of the tile the bitmap is
+func (b *Bitmap) Name() string {
+	return b.name
+}
+
+// Shows def until the tile has loaded. def may be nil once the manager is
+// closed or its textures reset, leaving nothing to draw. Must be called with
+// tileLock held.
+func (b *Bitmap) setPlaceholder(def *Bitmap) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ready = false
+	if def == nil {
+		b.tex, b.offX, b.offY = 0, 0, 0
+		b.w, b.h = DEFAULT_TILE_WIDTH, DEFAULT_TILE_HEIGHT
+		return
+	}
+	b.tex, b.offX, b.offY, b.w, b.h = def.tex, def.offX, def.offY, def.w, def.h
 }
 
 // Infomation about a tile in the atlas
@@ -35,9 +103,48 @@ type tileMetadata struct {
 
 type ResourceManager struct {
 	tileMetadatas map[string]tileMetadata
-	tileBmps      map[string]Bitmap
 
-	fontMap map[string]*allegro.Font
+	// Guards everything below it, and the textures of the Bitmaps in
+	// tileBmps
+	tileLock    sync.RWMutex
+	tileBmps    map[string]*Bitmap
+	failedTiles map[string]bool
+	// Names GetTileOrDefault has warned about, as it is called every frame
+	missingTiles map[string]bool
+	streamer     *tileStreamer
+
+	// Estimated GPU memory used by tile textures, and the most it may use.
+	// A budget of 0 is unlimited.
+	textureBytes  int64
+	textureBudget int64
+	evictions     int
+	frame         uint64
+
+	// Guards defaultTile, which is created when first needed and again
+	// after ResetTextures. defaultGen counts the resets.
+	defaultLock sync.Mutex
+	defaultTile *Bitmap
+	defaultGen  int
+	closed      bool
+	closeOnce   sync.Once
+
+	// Only written while CreateResourceManager runs, and never by Close, so
+	// need no lock
+	tileConfigs map[string]TileConfig
+	fontConfigs map[string]FontConfig
+	glyphFonts  map[string]*GlyphFont
+	glyphAtlas  *glyphAtlas
+
+	// TrueType fonts are only loaded into allegro when GetFont asks for
+	// them, as text is normally drawn from their GlyphFonts
+	fontLock sync.Mutex
+	fontMap  map[string]*allegro.Font
+
+	// How textures are made and freed, and how to get onto the render
+	// thread. Replaced in tests, which have no GL context.
+	uploadTexture func(*image.RGBA) gl.Texture
+	deleteTexture func(gl.Texture)
+	runInThread   func(func())
 }
 
 func CreateResourceManager(config *ResourceManagerConfig) *ResourceManager {
@@ -97,11 +204,29 @@ func CreateResourceManager(config *ResourceManagerConfig) *ResourceManager {
 
 	var manager ResourceManager
 	manager.tileMetadatas = make(map[string]tileMetadata)
-	manager.tileBmps = make(map[string]Bitmap)
+	manager.tileBmps = make(map[string]*Bitmap)
+	manager.failedTiles = make(map[string]bool)
+	manager.missingTiles = make(map[string]bool)
+	manager.uploadTexture = uploadTexture
+	manager.deleteTexture = func(tex gl.Texture) { tex.Delete() }
+	manager.runInThread = allegro.RunInThread
+
+	// Later configs override earlier ones of the same name
+	manager.tileConfigs = make(map[string]TileConfig)
+	for _, v := range config.TileConfigs {
+		manager.tileConfigs[v.Name] = v
+	}
+	manager.streamer = createTileStreamer(manager.tileConfig)
 	
 	// Load the fonts
+	manager.fontConfigs = make(map[string]FontConfig)
 	manager.fontMap = make(map[string]*allegro.Font)
 	for _, v := range config.FontConfigs {
+		manager.fontConfigs[v.Name] = v
+		if isTrueType(v.Filename) {
+			delete(manager.fontMap, v.Name)
+			continue
+		}
 		var font *allegro.Font
 		if v.Filename == "builtin" {
 			font = allegro.CreateBuiltinFont()
@@ -110,55 +235,438 @@ func CreateResourceManager(config *ResourceManagerConfig) *ResourceManager {
 		}
 		manager.fontMap[v.Name] = font
 	}
+	manager.loadGlyphFonts()
 
 	return &manager
 }
 
+// Returns the named tile, which shows the default tile until it has loaded.
+// The same Bitmap is returned every time, and may be kept. The tile starts
+// loading when first asked for; once evicted, it is only loaded again when
+// prioritized with PrioritizeTile.
+//
+// Safe for concurrent use. Any number of callers asking for the same tile
+// share a single load.
 func (rm *ResourceManager) GetTile(name string) (*Bitmap, bool) {
+	if name == DEFAULT_TILE_NAME {
+		return rm.GetDefaultTile(), true
+	}
+
+	rm.tileLock.RLock()
 	bmp, ok := rm.tileBmps[name]
+	failed := rm.failedTiles[name]
+	rm.tileLock.RUnlock()
+	if failed {
+		return nil, false
+	}
 	if !ok {
-		return rm.loadTile(name)
+		// Make sure the default tile exists before taking the lock, as
+		// creating it needs the render thread
+		def := rm.GetDefaultTile()
+
+		created := false
+		rm.tileLock.Lock()
+		bmp, ok = rm.tileBmps[name]
+		if !ok {
+			bmp = &Bitmap{name: name}
+			bmp.setPlaceholder(def)
+			rm.tileBmps[name] = bmp
+			created = true
+		}
+		rm.tileLock.Unlock()
+		if created {
+			rm.streamer.request(name, DEFAULT_PRIORITY)
+		}
 	}
-	return &bmp, true
+	return bmp, true
 }
 
 // Gets a tile that can be drawn, no matter what. Won't be pretty, but won't crash.
 func (rm *ResourceManager) GetDefaultTile() *Bitmap {
-	sub, ok := rm.GetTile(DEFAULT_TILE_NAME)
-	if !ok {
-		log.Panicf("Could not find default key in atlas: %v", DEFAULT_TILE_NAME)
+	for {
+		rm.defaultLock.Lock()
+		def, gen := rm.defaultTile, rm.defaultGen
+		closed := rm.closed
+		rm.defaultLock.Unlock()
+		if def != nil || closed {
+			return def
+		}
+
+		// Uploading waits for the render thread, which takes defaultLock in
+		// EndFrame, so the lock can't be held while it does
+		tex := rm.uploadDefaultTile()
+		bmp := &Bitmap{name: DEFAULT_TILE_NAME, tex: tex,
+			w: DEFAULT_TILE_WIDTH, h: DEFAULT_TILE_HEIGHT, ready: true}
+
+		rm.defaultLock.Lock()
+		switch {
+		case rm.defaultGen != gen:
+			// The textures were reset while uploading, so the texture
+			// went with the old GL context. Try again in the new one.
+			rm.defaultLock.Unlock()
+			continue
+		case rm.defaultTile == nil && !rm.closed:
+			rm.defaultTile = bmp
+			rm.defaultLock.Unlock()
+			rm.setPlaceholders(bmp)
+			return bmp
+		}
+		// Another caller got there first, or the manager was closed
+		def = rm.defaultTile
+		rm.defaultLock.Unlock()
+		rm.runInThread(func() {
+			rm.deleteTexture(tex)
+		})
+		return def
+	}
+}
+
+// Uploads the magenta checkerboard drawn in place of missing tiles
+func (rm *ResourceManager) uploadDefaultTile() gl.Texture {
+	img := image.NewRGBA(image.Rect(0, 0, DEFAULT_TILE_WIDTH, DEFAULT_TILE_HEIGHT))
+	magenta := color.RGBA{255, 0, 255, 255}
+	for x := 0; x < DEFAULT_TILE_WIDTH; x++ {
+		for y := 0; y < DEFAULT_TILE_HEIGHT; y++ {
+			if (x/16+y/16)%2 == 0 {
+				img.SetRGBA(x, y, magenta)
+			}
+		}
+	}
+	var tex gl.Texture
+	rm.runInThread(func() {
+		tex = rm.uploadTexture(img)
+	})
+	return tex
+}
+
+// Points every tile that hasn't loaded at the new default tile
+func (rm *ResourceManager) setPlaceholders(def *Bitmap) {
+	rm.tileLock.Lock()
+	defer rm.tileLock.Unlock()
+	for _, bmp := range rm.tileBmps {
+		if !bmp.ready {
+			bmp.setPlaceholder(def)
+		}
 	}
-	return sub
 }
 
 func (rm *ResourceManager) GetTileOrDefault(name string) *Bitmap {
 	tile, ok := rm.GetTile(name)
 	if !ok {
-		log.Printf("Could not find tile named %q. Defaulting to default tile.", name)
+		rm.tileLock.Lock()
+		if !rm.missingTiles[name] {
+			log.Printf("Could not find tile named %q. Defaulting to default tile.", name)
+			rm.missingTiles[name] = true
+		}
+		rm.tileLock.Unlock()
 		return rm.GetDefaultTile()
 	}
 	return tile
 }
 
 func (rm *ResourceManager) GetFont(name string) (*allegro.Font, bool) {
+	rm.fontLock.Lock()
+	defer rm.fontLock.Unlock()
 	font, ok := rm.fontMap[name]
-	return font, ok && font != nil
+	if !ok {
+		conf, ok := rm.fontConfigs[name]
+		if !ok || rm.fontMap == nil {
+			return nil, false
+		}
+		font = allegro.LoadFont(conf.Filename, conf.Size, 0)
+		rm.fontMap[name] = font
+	}
+	return font, font != nil
 }
 
-func (rm *ResourceManager) loadTile(name string) (*Bitmap, bool) {
-	fname, _ := filepath.Abs(path.Join("resources", name))
-	var tex gl.Texture
-	allegro.RunInThread(func() {
-		tex = gl.GenTexture()
-		tex.Bind(gl.TEXTURE_2D)
-		glfw.LoadTexture2D(fname, 0)
+// Returns the named TrueType font, drawn from the glyph atlas. Use this rather
+// than GetFont for text that may contain characters outside of ASCII.
+func (rm *ResourceManager) GetGlyphFont(name string) (*GlyphFont, bool) {
+	font, ok := rm.glyphFonts[name]
+	return font, ok
+}
+
+// Creates a GlyphFont for every TrueType font, with its fallbacks resolved
+func (rm *ResourceManager) loadGlyphFonts() {
+	rm.glyphAtlas = &glyphAtlas{}
+	rm.glyphFonts = make(map[string]*GlyphFont)
+
+	ttfs := make(map[string]*truetype.Font)
+	for name, conf := range rm.fontConfigs {
+		if !isTrueType(conf.Filename) {
+			continue
+		}
+		ttf, err := loadTrueType(conf.Filename)
+		if err != nil {
+			log.Printf("Could not load font %q from %q: %v", name, conf.Filename, err)
+			continue
+		}
+		ttfs[name] = ttf
+	}
+
+	for name, ttf := range ttfs {
+		conf := rm.fontConfigs[name]
+		fonts := []*truetype.Font{ttf}
+		for _, fallback := range conf.Fallbacks {
+			fallbackTTF, ok := ttfs[fallback]
+			if !ok {
+				log.Printf("Font %q's fallback %q is not a TrueType font", name, fallback)
+				continue
+			}
+			fonts = append(fonts, fallbackTTF)
+		}
+		rm.glyphFonts[name] = createGlyphFont(fonts, conf.Size, rm.glyphAtlas)
+	}
+}
+
+// Whether the font can be drawn from the glyph atlas. OpenType fonts with
+// CFF outlines can't be parsed, so .otf fonts are left to allegro.
+func isTrueType(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".ttf"
+}
+
+// Hints that the named tile is wanted soon. Lower priorities are loaded
+// first; the display engine uses the distance from the centre of the screen.
+// A tile still waiting to load takes the latest priority it was given.
+func (rm *ResourceManager) PrioritizeTile(bmp *Bitmap, priority float64) {
+	if bmp.Ready() || bmp.name == DEFAULT_TILE_NAME {
+		return
+	}
+	rm.tileLock.RLock()
+	failed := rm.failedTiles[bmp.name]
+	rm.tileLock.RUnlock()
+	if !failed {
+		rm.streamer.request(bmp.name, priority)
+	}
+}
+
+// Uploads up to max tiles that have finished decoding to the GPU, returning
+// how many were uploaded. Must be called on the render thread.
+func (rm *ResourceManager) UploadPendingTiles(max int) int {
+	decoded := rm.streamer.takeDecoded(max)
+	for _, tile := range decoded {
+		if tile.img == nil {
+			log.Printf("Could not load tile %q from %q", tile.name, rm.tileConfig(tile.name).Filename)
+			rm.tileLock.Lock()
+			rm.failedTiles[tile.name] = true
+			delete(rm.tileBmps, tile.name)
+			rm.tileLock.Unlock()
+			continue
+		}
+
+		tex := rm.uploadTexture(tile.img)
+		bounds := tile.img.Bounds()
+		rm.tileLock.Lock()
+		if bmp, ok := rm.tileBmps[tile.name]; ok && !bmp.ready {
+			bmp.lock.Lock()
+			bmp.tex, bmp.offX, bmp.offY = tex, tile.meta.offx, tile.meta.offy
+			bmp.w, bmp.h = bounds.Dx(), bounds.Dy()
+			bmp.ready = true
+			bmp.lock.Unlock()
+			atomic.StoreUint64(&bmp.lastDrawn, atomic.LoadUint64(&rm.frame))
+			rm.textureBytes += textureSize(bmp)
+		} else {
+			// Already loaded by an earlier request, or nobody wants it
+			// any more
+			rm.deleteTexture(tex)
+		}
+		rm.tileLock.Unlock()
+	}
+	return len(decoded)
+}
+
+// Records that the bitmap was drawn this frame. Bitmaps that have not been
+// drawn for the longest are the first to be evicted.
+func (rm *ResourceManager) MarkDrawn(bmp *Bitmap) {
+	atomic.StoreUint64(&bmp.lastDrawn, atomic.LoadUint64(&rm.frame))
+}
+
+// Sets the estimated GPU memory, in bytes, that tile textures may use. 0 means
+// unlimited.
+func (rm *ResourceManager) SetTextureBudget(bytes int64) {
+	rm.tileLock.Lock()
+	rm.textureBudget = bytes
+	rm.tileLock.Unlock()
+}
+
+// Evicts the least recently drawn tiles until texture memory is within
+// budget, then starts a new frame. Tiles drawn in the frame just finished are
+// never evicted. Evicted tiles show the default tile again until they are
+// reloaded. Must be called on the render thread.
+func (rm *ResourceManager) EndFrame() {
+	frame := atomic.LoadUint64(&rm.frame)
+	// The default tile can't be created here, as creating it waits for the
+	// render thread. Without it there is nothing to stand in for evicted
+	// tiles, so eviction waits for the next frame.
+	rm.defaultLock.Lock()
+	def := rm.defaultTile
+	rm.defaultLock.Unlock()
+
+	rm.tileLock.Lock()
+	if def != nil && rm.textureBudget > 0 && rm.textureBytes > rm.textureBudget {
+		var loaded []*Bitmap
+		for _, bmp := range rm.tileBmps {
+			if bmp.ready && atomic.LoadUint64(&bmp.lastDrawn) < frame {
+				loaded = append(loaded, bmp)
+			}
+		}
+		sort.Sort(byLastDrawn(loaded))
+		for _, bmp := range loaded {
+			if rm.textureBytes <= rm.textureBudget {
+				break
+			}
+			rm.textureBytes -= textureSize(bmp)
+			rm.evictions++
+			rm.deleteTexture(bmp.tex)
+			bmp.setPlaceholder(def)
+		}
+	}
+	rm.tileLock.Unlock()
+
+	atomic.AddUint64(&rm.frame, 1)
+}
+
+// Stops loading tiles, and frees every texture and font. Neither the
+// ResourceManager nor anything it handed out may be used afterwards. Safe to
+// call more than once.
+func (rm *ResourceManager) Close() {
+	rm.closeOnce.Do(func() {
+		rm.streamer.stop()
+
+		rm.tileLock.Lock()
+		var texs []gl.Texture
+		for _, bmp := range rm.tileBmps {
+			if bmp.ready {
+				texs = append(texs, bmp.tex)
+			}
+			bmp.setPlaceholder(nil)
+		}
+		rm.tileBmps = make(map[string]*Bitmap)
+		rm.textureBytes = 0
+		rm.tileLock.Unlock()
+
+		// Stop GetDefaultTile creating the default tile from now on
+		rm.defaultLock.Lock()
+		rm.closed = true
+		def := rm.defaultTile
+		rm.defaultTile = nil
+		rm.defaultLock.Unlock()
+
+		// Stop GetFont loading fonts from now on
+		rm.fontLock.Lock()
+		fonts := rm.fontMap
+		rm.fontMap = nil
+		rm.fontLock.Unlock()
+
+		rm.runInThread(func() {
+			for _, tex := range texs {
+				rm.deleteTexture(tex)
+			}
+			if def != nil {
+				rm.deleteTexture(def.tex)
+			}
+			rm.glyphAtlas.free()
+			for _, font := range fonts {
+				if font != nil {
+					font.Destroy()
+				}
+			}
+		})
 	})
-	bmp := Bitmap{tex, 0, 0, DEFAULT_TILE_WIDTH, DEFAULT_TILE_HEIGHT}
-	rm.tileBmps[name] = bmp
-	return &bmp, true
+}
+
+// Forgets every texture without deleting it, for when the GL context has been
+// destroyed along with the display. The default tile is uploaded again
+// straight away, and the other tiles as they are next requested; glyphs are
+// uploaded again when next drawn. Must not be called on the render thread.
+func (rm *ResourceManager) ResetTextures() {
+	rm.tileLock.Lock()
+	for _, bmp := range rm.tileBmps {
+		bmp.setPlaceholder(nil)
+	}
+	rm.textureBytes = 0
+	rm.tileLock.Unlock()
+
+	rm.defaultLock.Lock()
+	rm.defaultTile = nil
+	rm.defaultGen++
+	rm.defaultLock.Unlock()
+
+	rm.glyphAtlas.reset()
+	rm.GetDefaultTile()
+}
+
+// Texture memory usage, for the debug overlay
+type TextureStats struct {
+	// Number of tile textures resident on the GPU
+	Textures int
+	// Estimated bytes used by them, and the budget (0 if unlimited)
+	Bytes, Budget int64
+	// Total number of textures evicted to stay within budget
+	Evictions int
+	// Number of tiles waiting to be loaded
+	Pending int
+}
+
+func (rm *ResourceManager) GetTextureStats() TextureStats {
+	var stats TextureStats
+	rm.tileLock.RLock()
+	for _, bmp := range rm.tileBmps {
+		if bmp.ready {
+			stats.Textures++
+		}
+	}
+	stats.Bytes = rm.textureBytes
+	stats.Budget = rm.textureBudget
+	stats.Evictions = rm.evictions
+	rm.tileLock.RUnlock()
+	stats.Pending = rm.streamer.pending()
+	return stats
+}
+
+// Estimated GPU memory used by the bitmap's texture
+func textureSize(bmp *Bitmap) int64 {
+	return int64(bmp.w) * int64(bmp.h) * 4
+}
+
+type byLastDrawn []*Bitmap
+
+func (b byLastDrawn) Len() int      { return len(b) }
+func (b byLastDrawn) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLastDrawn) Less(i, j int) bool {
+	return atomic.LoadUint64(&b[i].lastDrawn) < atomic.LoadUint64(&b[j].lastDrawn)
+}
+
+// Where the named tile is loaded from. Tiles not listed in any resources.ini
+// are the whole of the file of the same name in the resources directory.
+func (rm *ResourceManager) tileConfig(name string) TileConfig {
+	if conf, ok := rm.tileConfigs[name]; ok {
+		return conf
+	}
+	fname, _ := filepath.Abs(path.Join("resources", name))
+	return TileConfig{Name: name, Filename: fname}
+}
+
+// Returns the resource pack root that supplied the named tile
+func (rm *ResourceManager) GetTilePack(name string) (string, bool) {
+	conf, ok := rm.tileConfigs[name]
+	return conf.Pack, ok
+}
+
+// Returns the resource pack root that supplied the named font
+func (rm *ResourceManager) GetFontPack(name string) (string, bool) {
+	conf, ok := rm.fontConfigs[name]
+	return conf.Pack, ok
 }
 
 func generateMetadata(bmp *allegro.Bitmap, cfg TileConfig) tileMetadata {
+	bmpw, bmph := bmp.GetDimensions()
+	return sanitizeMetadata(bmpw, bmph, cfg)
+}
+
+// The tile's area of an image of the given size, clamped to fit. A width or
+// height of 0 is to the edge of the image.
+func sanitizeMetadata(bmpw, bmph int, cfg TileConfig) tileMetadata {
 	// Load the metadata, and then sanitize it
 	x := cfg.X
 	y := cfg.Y
@@ -166,7 +674,6 @@ func generateMetadata(bmp *allegro.Bitmap, cfg TileConfig) tileMetadata {
 	h := cfg.H
 	ox := cfg.OffX
 	oy := cfg.OffY
-	bmpw, bmph := bmp.GetDimensions()
 	if bmpw < x {
 		x = 0
 		w = bmpw
@@ -0,0 +1,414 @@
+package resources
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gl/gl"
+)
+
+// Stands in for the GL context and render thread, keeping track of which
+// textures exist so that drawing or deleting a dead one can be caught
+type fakeGPU struct {
+	t *testing.T
+	// Held while on the render thread
+	thread sync.Mutex
+
+	lock sync.Mutex
+	live map[gl.Texture]bool
+	next gl.Texture
+}
+
+func newFakeGPU(t *testing.T) *fakeGPU {
+	return &fakeGPU{t: t, live: make(map[gl.Texture]bool)}
+}
+
+func (g *fakeGPU) install(rm *ResourceManager) {
+	rm.uploadTexture = g.upload
+	rm.deleteTexture = g.delete
+	rm.runInThread = g.run
+}
+
+func (g *fakeGPU) run(fn func()) {
+	g.thread.Lock()
+	defer g.thread.Unlock()
+	fn()
+}
+
+func (g *fakeGPU) upload(img *image.RGBA) gl.Texture {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.next++
+	g.live[g.next] = true
+	return g.next
+}
+
+func (g *fakeGPU) delete(tex gl.Texture) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.live[tex] {
+		g.t.Errorf("texture %v deleted when it didn't exist", tex)
+	}
+	delete(g.live, tex)
+}
+
+// Checks the bitmap's texture can be drawn. Must be called on the render
+// thread.
+func (g *fakeGPU) draw(bmp *Bitmap) {
+	tex := bmp.Texture()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if tex != 0 && !g.live[tex] {
+		g.t.Errorf("tile %q drawn with dead texture %v", bmp.Name(), tex)
+	}
+}
+
+// Forgets every texture, as if the GL context was destroyed
+func (g *fakeGPU) lose() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.live = make(map[gl.Texture]bool)
+}
+
+func (g *fakeGPU) count() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return len(g.live)
+}
+
+// Writes n small tiles to dir, returning their configs
+func writeTiles(t *testing.T, dir string, n int) []TileConfig {
+	var confs []TileConfig
+	for i := 0; i < n; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+		img.Set(0, 0, color.RGBA{uint8(i), 0, 0, 255})
+		fname := filepath.Join(dir, fmt.Sprintf("tile%v.png", i))
+		file, err := os.Create(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(file, img); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+		confs = append(confs, TileConfig{Name: fmt.Sprintf("tile%v", i), Filename: fname})
+	}
+	return confs
+}
+
+// Hammers the manager from several goroutines while the render thread
+// uploads, evicts and resets textures. Run with -race.
+func TestResourceManagerConcurrentUse(t *testing.T) {
+	const (
+		nTiles   = 16
+		nWorkers = 8
+		nOps     = 300
+	)
+	confs := writeTiles(t, t.TempDir(), nTiles)
+	rm := CreateResourceManager(&ResourceManagerConfig{TileConfigs: confs})
+	gpu := newFakeGPU(t)
+	gpu.install(rm)
+	// Room for a few tiles, so that most get evicted
+	rm.SetTextureBudget(4 * 8 * 8 * 4)
+
+	// Held for writing while the textures are reset, as the display engine
+	// holds drawLock while switching modes
+	var drawLock sync.RWMutex
+	done := make(chan struct{})
+	var render sync.WaitGroup
+	render.Add(1)
+	go func() {
+		defer render.Done()
+		for frame := 0; ; frame++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			drawLock.RLock()
+			gpu.run(func() {
+				rm.UploadPendingTiles(4)
+				rm.EndFrame()
+			})
+			drawLock.RUnlock()
+			if frame%50 == 49 {
+				drawLock.Lock()
+				gpu.lose()
+				rm.ResetTextures()
+				drawLock.Unlock()
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		workers.Add(1)
+		go func(seed int64) {
+			defer workers.Done()
+			r := rand.New(rand.NewSource(seed))
+			// Kept across "frames", as games are allowed to
+			held := make(map[string]*Bitmap)
+			for i := 0; i < nOps; i++ {
+				name := fmt.Sprintf("tile%v", r.Intn(nTiles))
+				bmp, ok := held[name]
+				if !ok || r.Intn(4) == 0 {
+					bmp, ok = rm.GetTile(name)
+					if !ok {
+						t.Errorf("GetTile(%q) failed", name)
+						return
+					}
+					if old, ok := held[name]; ok && old != bmp {
+						t.Errorf("GetTile(%q) returned a different bitmap", name)
+					}
+					held[name] = bmp
+				}
+				rm.PrioritizeTile(bmp, r.Float64()*100)
+				bmp.Ready()
+				bmp.Size()
+				drawLock.RLock()
+				gpu.run(func() {
+					gpu.draw(bmp)
+					rm.MarkDrawn(bmp)
+				})
+				drawLock.RUnlock()
+				rm.GetTextureStats()
+			}
+		}(int64(w))
+	}
+	workers.Wait()
+	close(done)
+	render.Wait()
+
+	// A bitmap that is kept and drawn every frame must finish loading
+	bmp, _ := rm.GetTile("tile0")
+	deadline := time.Now().Add(10 * time.Second)
+	for !bmp.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("tile0 never finished loading")
+		}
+		rm.PrioritizeTile(bmp, 0)
+		gpu.run(func() {
+			rm.UploadPendingTiles(4)
+			gpu.draw(bmp)
+			rm.MarkDrawn(bmp)
+			rm.EndFrame()
+		})
+		time.Sleep(time.Millisecond)
+	}
+
+	if rm.GetTextureStats().Evictions == 0 {
+		t.Error("no tiles were evicted, so eviction wasn't tested")
+	}
+
+	rm.Close()
+	if n := gpu.count(); n != 0 {
+		t.Errorf("%v textures still exist after Close", n)
+	}
+	if stats := rm.GetTextureStats(); stats.Bytes != 0 || stats.Textures != 0 {
+		t.Errorf("stats after Close = %+v, want no textures", stats)
+	}
+}
+
+// Waits for the number of goroutines to drop back to want, failing if it
+// doesn't. Goroutines that have been told to stop may take a moment to exit.
+func checkGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines running, want %v", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamerStopLeaksNoGoroutines(t *testing.T) {
+	confs := writeTiles(t, t.TempDir(), 4)
+	before := runtime.NumGoroutine()
+
+	s := createTileStreamer(func(name string) TileConfig {
+		fname := filepath.Join(filepath.Dir(confs[0].Filename), name+".png")
+		return TileConfig{Name: name, Filename: fname}
+	})
+	for _, conf := range confs {
+		s.request(conf.Name, DEFAULT_PRIORITY)
+	}
+	s.stop()
+	checkGoroutines(t, before)
+
+	// Requests after stopping are ignored, rather than starting workers
+	s.request(confs[0].Name, DEFAULT_PRIORITY)
+	if n := s.pending(); n != 0 {
+		t.Errorf("%v tiles pending after stop, want 0", n)
+	}
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	confs := writeTiles(t, t.TempDir(), 4)
+	before := runtime.NumGoroutine()
+
+	rm := CreateResourceManager(&ResourceManagerConfig{TileConfigs: confs})
+	gpu := newFakeGPU(t)
+	gpu.install(rm)
+	for _, conf := range confs {
+		rm.GetTile(conf.Name)
+	}
+	gpu.run(func() { rm.UploadPendingTiles(len(confs)) })
+	rm.Close()
+	rm.Close()
+	checkGoroutines(t, before)
+	if n := gpu.count(); n != 0 {
+		t.Errorf("%v textures still exist after Close", n)
+	}
+}
+
+// Run with -race
+func TestGetGlyphFontDuringClose(t *testing.T) {
+	rm := CreateResourceManager(&ResourceManagerConfig{})
+	newFakeGPU(t).install(rm)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			rm.GetGlyphFont("missing")
+		}
+	}()
+	rm.Close()
+	<-done
+}
+
+func TestGetTileOrDefaultWarnsOnce(t *testing.T) {
+	rm := CreateResourceManager(&ResourceManagerConfig{})
+	gpu := newFakeGPU(t)
+	gpu.install(rm)
+	defer rm.Close()
+
+	// Wait for the tile to fail to load
+	rm.GetTile("missing")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gpu.run(func() { rm.UploadPendingTiles(1) })
+		if _, ok := rm.GetTile("missing"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("missing tile never failed to load")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	// As the display does each frame
+	for i := 0; i < 3; i++ {
+		if bmp := rm.GetTileOrDefault("missing"); bmp != rm.GetDefaultTile() {
+			t.Errorf("GetTileOrDefault of a missing tile = %v, want the default", bmp.Name())
+		}
+	}
+	if n := strings.Count(logged.String(), "Could not find tile"); n != 1 {
+		t.Errorf("missing tile warned about %v times, want once:\n%s", n, logged.String())
+	}
+}
+
+func TestStreamerTakesLatestPriority(t *testing.T) {
+	// No workers, so the queue can be inspected
+	s := &tileStreamer{
+		queued:   make(map[string]*tileRequest),
+		inflight: make(map[string]bool),
+	}
+	s.cond = sync.NewCond(&s.lock)
+
+	s.request("a", 1)
+	s.request("b", 2)
+	s.request("c", 3)
+	// The view moved: a is now furthest away, and c nearest
+	s.request("a", 10)
+	s.request("c", 0)
+
+	var order []string
+	for s.queue.Len() > 0 {
+		order = append(order, heap.Pop(&s.queue).(*tileRequest).name)
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("tiles queued in order %q, want %q", order, want)
+	}
+}
+
+func TestDecodeTileCrops(t *testing.T) {
+	// A sheet of two 8x8 tiles, red then blue
+	sheet := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			if x < 8 {
+				sheet.SetRGBA(x, y, red)
+			} else {
+				sheet.SetRGBA(x, y, blue)
+			}
+		}
+	}
+	fname := filepath.Join(t.TempDir(), "sheet.png")
+	file, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, sheet); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	tests := []struct {
+		conf       TileConfig
+		w, h       int
+		offX, offY int
+		corner     color.RGBA
+	}{
+		// The whole sheet
+		{TileConfig{}, 16, 8, 0, 0, red},
+		{TileConfig{X: 8, W: 8, H: 8, OffX: 2, OffY: 3}, 8, 8, 2, 3, blue},
+		// To the edge of the sheet
+		{TileConfig{X: 8}, 8, 8, 0, 0, blue},
+		// Clamped to the sheet
+		{TileConfig{X: 4, W: 100, H: 4}, 12, 4, 0, 0, red},
+		// Offsets bigger than the tile are dropped
+		{TileConfig{W: 8, H: 8, OffX: 9}, 8, 8, 0, 0, red},
+	}
+	for _, test := range tests {
+		test.conf.Filename = fname
+		img, meta := decodeTile(test.conf)
+		if img == nil {
+			t.Errorf("decodeTile(%+v) failed", test.conf)
+			continue
+		}
+		if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != test.w || h != test.h {
+			t.Errorf("decodeTile(%+v) is %vx%v, want %vx%v", test.conf, w, h, test.w, test.h)
+		}
+		if meta.offx != test.offX || meta.offy != test.offY {
+			t.Errorf("decodeTile(%+v) offset = %v,%v, want %v,%v", test.conf,
+				meta.offx, meta.offy, test.offX, test.offY)
+		}
+		min := img.Bounds().Min
+		if c := img.RGBAAt(min.X, min.Y); c != test.corner {
+			t.Errorf("decodeTile(%+v) top left = %v, want %v", test.conf, c, test.corner)
+		}
+	}
+
+	if img, _ := decodeTile(TileConfig{Filename: fname, X: 16}); img != nil {
+		t.Error("decodeTile with an empty area succeeded")
+	}
+}
@@ -0,0 +1,327 @@
+// Package resconfig reads resources.ini files, which list the tiles and fonts
+// in a resource pack. It doesn't need allegro, so can be used by tools and
+// tested without a display.
+package resconfig
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bluepeppers/danckelmann/config"
+)
+
+const (
+	// Default value for the size field of font resources
+	DEFAULT_SIZE = "12"
+)
+
+var (
+	sizeRegexp = regexp.MustCompile(`^\d+$`)
+)
+
+// Information on how to load a tile resouce.
+type TileConfig struct {
+	Name     string
+	Filename string
+
+	// Set any of these to 0 to use the default values
+	X, Y, W, H int
+	OffX, OffY int
+
+	// The resource pack root the tile was loaded from
+	Pack string
+}
+
+// Information on how to load a font resource.
+type FontConfig struct {
+	Name string
+	// If filename is `builtin`, will not check file exists
+	Filename string
+	Size     int
+	// Names of fonts to take glyphs from when this font lacks them, in order.
+	// Only used for TrueType fonts.
+	Fallbacks []string
+
+	// The resource pack root the font was loaded from
+	Pack string
+}
+
+type ResourceManagerConfig struct {
+	TileConfigs []TileConfig
+	FontConfigs []FontConfig
+}
+
+// A problem found while loading a resources.ini file. Key is empty if the
+// problem concerns the whole section, and Section is empty if it concerns the
+// whole file.
+type Diagnostic struct {
+	File    string
+	Section string
+	Key     string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	loc := d.File
+	if d.Section != "" {
+		loc += ": [" + d.Section + "]"
+	}
+	if d.Key != "" {
+		loc += " " + d.Key
+	}
+	return loc + ": " + d.Message
+}
+
+// Loads the resources.ini file in directory, and any subdirectories it
+// references. Every problem found is returned as a Diagnostic; the offending
+// resource is skipped or the offending field defaulted. If strict is set, any
+// diagnostic causes the load to fail.
+func LoadResourceManagerConfig(directory string, prefix string, strict bool) (*ResourceManagerConfig, []Diagnostic, bool) {
+	rmConfig, diags, ok := loadResourceManagerConfig(directory, prefix)
+	if !ok || (strict && len(diags) > 0) {
+		return nil, diags, false
+	}
+	return rmConfig, diags, true
+}
+
+func loadResourceManagerConfig(directory string, prefix string) (*ResourceManagerConfig, []Diagnostic, bool) {
+	configFilename := path.Join(directory, "resources.ini")
+	if _, err := os.Stat(configFilename); err != nil {
+		return nil, []Diagnostic{{File: configFilename, Message: err.Error()}}, false
+	}
+	rawConfig, err := config.LoadFile(configFilename)
+	if err != nil {
+		return nil, []Diagnostic{{File: configFilename, Message: err.Error()}}, false
+	}
+	rmConfig, diags := ParseResourceManagerConfig(rawConfig, configFilename, directory, prefix)
+	return rmConfig, diags, true
+}
+
+// Reads a resources.ini file's contents from rawConfig. Filenames in it are
+// relative to directory, and are checked to exist; subdirectories are loaded
+// from disk. Diagnostics name configFilename as the file the problems are in.
+func ParseResourceManagerConfig(rawConfig config.SectionedSource, configFilename, directory, prefix string) (*ResourceManagerConfig, []Diagnostic) {
+	var rmConfig ResourceManagerConfig
+	var diags []Diagnostic
+	report := func(section, key, format string, args ...interface{}) {
+		diags = append(diags, Diagnostic{configFilename, section, key,
+			fmt.Sprintf(format, args...)})
+	}
+
+	for _, sectionName := range rawConfig.Sections() {
+		resourceType, ok := rawConfig.Get(sectionName, "type")
+		if !ok {
+			report(sectionName, "type", "no type field, skipping section")
+			continue
+		}
+
+		switch resourceType {
+		case "tile":
+			tileConfig, ok := loadTileConfig(rawConfig, sectionName, prefix, directory, report)
+			if ok {
+				rmConfig.TileConfigs = append(rmConfig.TileConfigs, tileConfig)
+			}
+		case "font":
+			fontConfig, ok := loadFontConfig(rawConfig, sectionName, prefix, directory, report)
+			if ok {
+				rmConfig.FontConfigs = append(rmConfig.FontConfigs, fontConfig)
+			}
+		case "subdirectory":
+			fname, ok := rawConfig.Get(sectionName, "filename")
+			if !ok {
+				report(sectionName, "filename", "no filename field, skipping directory")
+				continue
+			}
+			dirname := path.Join(directory, fname)
+			stat, err := os.Stat(dirname)
+
+			if err != nil || !stat.Mode().IsDir() {
+				report(sectionName, "filename",
+					"%q is not a directory, skipping directory", dirname)
+				continue
+			}
+
+			var subPrefix string
+			if prefix != "" {
+				subPrefix = prefix + "." + sectionName
+			} else {
+				subPrefix = sectionName
+			}
+			subConfig, subDiags, ok := loadResourceManagerConfig(dirname, subPrefix)
+			diags = append(diags, subDiags...)
+			if ok {
+				rmConfig.Merge(subConfig)
+			}
+		default:
+			report(sectionName, "type",
+				"type %q was not recognised, skipping resource", resourceType)
+		}
+	}
+
+	return &rmConfig, diags
+}
+
+// Called for every problem found while loading a section
+type reportFunc func(section, key, format string, args ...interface{})
+
+// Parses an "x,y" pair field, defaulting to 0,0 if it is missing or invalid
+func loadPair(rawConfig config.Source, name, key string, report reportFunc) (int, int) {
+	value, ok := rawConfig.Get(name, key)
+	if !ok {
+		return 0, 0
+	}
+	x, y, ok := config.ParseIntPair(value)
+	if !ok || x < 0 || y < 0 {
+		report(name, key, "%q is not valid, using default of 0,0", value)
+		return 0, 0
+	}
+	return x, y
+}
+
+func loadTileConfig(rawConfig config.Source, name, prefix, directory string, report reportFunc) (TileConfig, bool) {
+	var tileConf TileConfig
+
+	if prefix != "" {
+		tileConf.Name = prefix + "." + name
+	} else {
+		tileConf.Name = name
+	}
+
+	fname, ok := rawConfig.Get(name, "filename")
+	if !ok {
+		report(name, "filename", "no filename field, skipping resource")
+		return tileConf, false
+	}
+	filename := path.Join(directory, fname)
+	if _, err := os.Stat(filename); err != nil {
+		report(name, "filename", "%v, skipping resource", err)
+		return tileConf, false
+	}
+	tileConf.Filename = filename
+
+	tileConf.X, tileConf.Y = loadPair(rawConfig, name, "position", report)
+	tileConf.W, tileConf.H = loadPair(rawConfig, name, "dimensions", report)
+	tileConf.OffX, tileConf.OffY = loadPair(rawConfig, name, "offset", report)
+
+	return tileConf, true
+}
+
+func loadFontConfig(rawConfig config.Source, name, prefix, directory string, report reportFunc) (FontConfig, bool) {
+	var fontConf FontConfig
+
+	if prefix != "" {
+		fontConf.Name = prefix + "." + name
+	} else {
+		fontConf.Name = name
+	}
+
+	fname, ok := rawConfig.Get(name, "filename")
+	if !ok {
+		report(name, "filename", "no filename field, skipping resource")
+		return fontConf, false
+	}
+	var filename string
+	if fname != "builtin" {
+		filename = path.Join(directory, fname)
+		if _, err := os.Stat(filename); err != nil {
+			report(name, "filename", "%v, skipping resource", err)
+			return fontConf, false
+		}
+	} else {
+		filename = fname
+	}
+	fontConf.Filename = filename
+
+	strSize, ok := rawConfig.Get(name, "size")
+	if !ok {
+		strSize = DEFAULT_SIZE
+	}
+	if !sizeRegexp.MatchString(strSize) {
+		report(name, "size", "%q is not valid, defaulting to %v",
+			strSize, DEFAULT_SIZE)
+		strSize = DEFAULT_SIZE
+	}
+	size, _ := strconv.Atoi(strSize)
+	fontConf.Size = size
+
+	fallbacks, _ := rawConfig.Get(name, "fallback")
+	for _, fallback := range strings.Split(fallbacks, ",") {
+		fallback = strings.TrimSpace(fallback)
+		if fallback != "" {
+			fontConf.Fallbacks = append(fontConf.Fallbacks, fallback)
+		}
+	}
+
+	return fontConf, true
+}
+
+func (rm *ResourceManagerConfig) Merge(sub *ResourceManagerConfig) {
+	rm.TileConfigs = append(rm.TileConfigs, sub.TileConfigs...)
+	rm.FontConfigs = append(rm.FontConfigs, sub.FontConfigs...)
+}
+
+// Replaces any resources in rm with those of the same name in over, and adds
+// the rest.
+func (rm *ResourceManagerConfig) Overlay(over *ResourceManagerConfig) {
+	tiles := make(map[string]int, len(rm.TileConfigs))
+	for i, tile := range rm.TileConfigs {
+		tiles[tile.Name] = i
+	}
+	for _, tile := range over.TileConfigs {
+		if i, ok := tiles[tile.Name]; ok {
+			rm.TileConfigs[i] = tile
+		} else {
+			tiles[tile.Name] = len(rm.TileConfigs)
+			rm.TileConfigs = append(rm.TileConfigs, tile)
+		}
+	}
+
+	fonts := make(map[string]int, len(rm.FontConfigs))
+	for i, font := range rm.FontConfigs {
+		fonts[font.Name] = i
+	}
+	for _, font := range over.FontConfigs {
+		if i, ok := fonts[font.Name]; ok {
+			rm.FontConfigs[i] = font
+		} else {
+			fonts[font.Name] = len(rm.FontConfigs)
+			rm.FontConfigs = append(rm.FontConfigs, font)
+		}
+	}
+}
+
+// Loads an ordered list of resource pack roots (e.g. base game, expansion,
+// then user mods), each with its own resources.ini. Resources in later packs
+// override those of the same name in earlier ones. The first root is required;
+// later ones that fail to load are skipped, unless strict is set.
+func LoadResourcePacks(roots []string, strict bool) (*ResourceManagerConfig, []Diagnostic, bool) {
+	if len(roots) == 0 {
+		return nil, []Diagnostic{{Message: "no resource packs given"}}, false
+	}
+
+	var rmConfig ResourceManagerConfig
+	var diags []Diagnostic
+	for i, root := range roots {
+		packConfig, packDiags, ok := LoadResourceManagerConfig(root, "", strict)
+		diags = append(diags, packDiags...)
+		if !ok {
+			if i == 0 || strict {
+				return nil, diags, false
+			}
+			continue
+		}
+
+		for j := range packConfig.TileConfigs {
+			packConfig.TileConfigs[j].Pack = root
+		}
+		for j := range packConfig.FontConfigs {
+			packConfig.FontConfigs[j].Pack = root
+		}
+		rmConfig.Overlay(packConfig)
+	}
+	return &rmConfig, diags, true
+}
@@ -0,0 +1,223 @@
+package resconfig
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bluepeppers/danckelmann/config"
+)
+
+// Creates empty files in dir
+func touch(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The section and key of each diagnostic
+func diagKeys(diags []Diagnostic) [][2]string {
+	var keys [][2]string
+	for _, diag := range diags {
+		keys = append(keys, [2]string{diag.Section, diag.Key})
+	}
+	return keys
+}
+
+func TestParseResourceManagerConfig(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "grass.png", "label.ttf")
+	ini := config.ParseINI(`
+[grass]
+type = tile
+filename = grass.png
+position = 0, 64
+dimensions = 58,30
+offset = 2,3
+
+[label]
+type = font
+filename = label.ttf
+size = 14
+fallback = builtin, cjk
+
+[builtin]
+type = font
+filename = builtin
+`)
+	conf, diags := ParseResourceManagerConfig(ini, "resources.ini", dir, "base")
+	if len(diags) != 0 {
+		t.Errorf("unexpected diagnostics: %v", diags)
+	}
+
+	wantTiles := []TileConfig{{
+		Name:     "base.grass",
+		Filename: filepath.Join(dir, "grass.png"),
+		X:        0, Y: 64, W: 58, H: 30,
+		OffX: 2, OffY: 3,
+	}}
+	if !reflect.DeepEqual(conf.TileConfigs, wantTiles) {
+		t.Errorf("tiles = %+v, want %+v", conf.TileConfigs, wantTiles)
+	}
+	wantFonts := []FontConfig{{
+		Name:      "base.label",
+		Filename:  filepath.Join(dir, "label.ttf"),
+		Size:      14,
+		Fallbacks: []string{"builtin", "cjk"},
+	}, {
+		Name:     "base.builtin",
+		Filename: "builtin",
+		Size:     12,
+	}}
+	if !reflect.DeepEqual(conf.FontConfigs, wantFonts) {
+		t.Errorf("fonts = %+v, want %+v", conf.FontConfigs, wantFonts)
+	}
+}
+
+func TestParseResourceManagerConfigDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "grass.png")
+	ini := config.ParseINI(`
+[notype]
+filename = grass.png
+
+[nofile]
+type = tile
+
+[missing]
+type = tile
+filename = missing.png
+
+[badpair]
+type = tile
+filename = grass.png
+position = 1;2
+
+[negative]
+type = tile
+filename = grass.png
+dimensions = -8,8
+
+[badsize]
+type = font
+filename = builtin
+size = big
+
+[sound]
+type = sound
+`)
+	conf, diags := ParseResourceManagerConfig(ini, "pack/resources.ini", dir, "")
+
+	want := [][2]string{
+		{"notype", "type"},
+		{"nofile", "filename"},
+		{"missing", "filename"},
+		{"badpair", "position"},
+		{"negative", "dimensions"},
+		{"badsize", "size"},
+		{"sound", "type"},
+	}
+	if got := diagKeys(diags); !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics for %v, want %v", got, want)
+	}
+	for _, diag := range diags {
+		if diag.File != "pack/resources.ini" || diag.Message == "" {
+			t.Errorf("diagnostic %+v lacks a file or message", diag)
+		}
+	}
+
+	// Resources with bad fields are kept, with the field defaulted
+	if len(conf.TileConfigs) != 2 || conf.TileConfigs[0].Name != "badpair" ||
+		conf.TileConfigs[0].X != 0 || conf.TileConfigs[0].Y != 0 ||
+		conf.TileConfigs[1].W != 0 || conf.TileConfigs[1].H != 0 {
+		t.Errorf("tiles = %+v, want badpair at 0,0 and negative of size 0,0", conf.TileConfigs)
+	}
+	if len(conf.FontConfigs) != 1 || conf.FontConfigs[0].Size != 12 {
+		t.Errorf("fonts = %+v, want just badsize of size 12", conf.FontConfigs)
+	}
+}
+
+func TestDiagnosticString(t *testing.T) {
+	tests := []struct {
+		diag Diagnostic
+		want string
+	}{
+		{Diagnostic{"a/resources.ini", "grass", "filename", "missing"},
+			"a/resources.ini: [grass] filename: missing"},
+		{Diagnostic{"a/resources.ini", "grass", "", "bad"},
+			"a/resources.ini: [grass]: bad"},
+		{Diagnostic{"a/resources.ini", "", "", "unreadable"},
+			"a/resources.ini: unreadable"},
+	}
+	for _, test := range tests {
+		if got := test.diag.String(); got != test.want {
+			t.Errorf("String() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+// Writes a resources.ini with the contents to a new directory, returning it
+func writePack(t *testing.T, ini string, files ...string) string {
+	dir := t.TempDir()
+	touch(t, dir, files...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "resources.ini"), []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadResourceManagerConfigStrict(t *testing.T) {
+	dir := writePack(t, "[grass]\ntype = tile\nfilename = grass.png\n\n[bad]\ntype = sound\n",
+		"grass.png")
+	ini := filepath.Join(dir, "resources.ini")
+
+	conf, diags, ok := LoadResourceManagerConfig(dir, "", false)
+	if !ok || len(conf.TileConfigs) != 1 || len(diags) != 1 {
+		t.Fatalf("non-strict load = %+v, %v, %v, want grass loaded and one diagnostic",
+			conf, diags, ok)
+	}
+	want := []Diagnostic{{ini, "bad", "type", diags[0].Message}}
+	if !reflect.DeepEqual(diags, want) {
+		t.Errorf("diagnostics = %v, want %v", diags, want)
+	}
+
+	conf, strictDiags, ok := LoadResourceManagerConfig(dir, "", true)
+	if ok || conf != nil {
+		t.Errorf("strict load succeeded despite diagnostics")
+	}
+	if !reflect.DeepEqual(strictDiags, diags) {
+		t.Errorf("strict diagnostics = %v, want %v", strictDiags, diags)
+	}
+
+	// A missing file is reported against it, and fails even without strict
+	missing := filepath.Join(t.TempDir(), "none")
+	_, diags, ok = LoadResourceManagerConfig(missing, "", false)
+	if ok || len(diags) != 1 || diags[0].File != filepath.Join(missing, "resources.ini") {
+		t.Errorf("load of a missing pack = %v, %v, want one diagnostic for its file", diags, ok)
+	}
+}
+
+func TestLoadResourcePacks(t *testing.T) {
+	base := writePack(t, "[grass]\ntype = tile\nfilename = grass.png\n", "grass.png")
+	mod := writePack(t, "[grass]\ntype = tile\nfilename = grass2.png\n", "grass2.png")
+	missing := filepath.Join(t.TempDir(), "none")
+
+	conf, diags, ok := LoadResourcePacks([]string{base, missing, mod}, false)
+	if !ok || len(diags) != 1 {
+		t.Fatalf("LoadResourcePacks = %v, %v, want a missing pack skipped", diags, ok)
+	}
+	if len(conf.TileConfigs) != 1 || conf.TileConfigs[0].Pack != mod ||
+		conf.TileConfigs[0].Filename != filepath.Join(mod, "grass2.png") {
+		t.Errorf("tiles = %+v, want grass from the last pack", conf.TileConfigs)
+	}
+
+	if _, _, ok := LoadResourcePacks([]string{base, missing, mod}, true); ok {
+		t.Error("strict LoadResourcePacks with a missing pack succeeded")
+	}
+	if _, _, ok := LoadResourcePacks([]string{missing, base}, false); ok {
+		t.Error("LoadResourcePacks with a missing first pack succeeded")
+	}
+}
@@ -0,0 +1,220 @@
+package resources
+
+import (
+	"container/heap"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/go-gl/gl"
+)
+
+const (
+	// Priority given to tiles that nobody has asked to be prioritized. Lower
+	// priorities are loaded first.
+	DEFAULT_PRIORITY = 1e9
+)
+
+// A tile waiting to be decoded
+type tileRequest struct {
+	name     string
+	priority float64
+	index    int
+}
+
+// Min-heap of tileRequests, ordered by priority
+type requestQueue []*tileRequest
+
+func (q requestQueue) Len() int           { return len(q) }
+func (q requestQueue) Less(i, j int) bool { return q[i].priority < q[j].priority }
+func (q requestQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *requestQueue) Push(x interface{}) {
+	req := x.(*tileRequest)
+	req.index = len(*q)
+	*q = append(*q, req)
+}
+
+func (q *requestQueue) Pop() interface{} {
+	old := *q
+	req := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return req
+}
+
+// A tile that has been decoded, and is waiting to be uploaded to the GPU. img
+// is nil if decoding failed.
+type decodedTile struct {
+	name string
+	img  *image.RGBA
+	// The tile's area of its file, and its offset
+	meta tileMetadata
+}
+
+// Decodes tiles on a pool of worker goroutines, nearest first. The results are
+// collected until the render thread uploads them.
+type tileStreamer struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	queue   requestQueue
+	queued  map[string]*tileRequest
+	decoded []decodedTile
+	// Tiles that are being decoded or waiting to be uploaded
+	inflight map[string]bool
+	stopped  bool
+	workers  sync.WaitGroup
+
+	// Where to load each tile from
+	config func(string) TileConfig
+}
+
+func createTileStreamer(config func(string) TileConfig) *tileStreamer {
+	s := &tileStreamer{
+		queued:   make(map[string]*tileRequest),
+		inflight: make(map[string]bool),
+		config:   config,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		s.workers.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+// Queues the tile to be decoded. If it is already queued, its priority is
+// replaced, as where it is on the screen may have changed since. Tiles that
+// have already been decoded but not yet uploaded are not queued again.
+func (s *tileStreamer) request(name string, priority float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped || s.inflight[name] {
+		return
+	}
+	if req, ok := s.queued[name]; ok {
+		if priority != req.priority {
+			req.priority = priority
+			heap.Fix(&s.queue, req.index)
+		}
+		return
+	}
+	req := &tileRequest{name: name, priority: priority}
+	heap.Push(&s.queue, req)
+	s.queued[name] = req
+	s.cond.Signal()
+}
+
+// Takes up to max decoded tiles, for uploading
+func (s *tileStreamer) takeDecoded(max int) []decodedTile {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := len(s.decoded)
+	if n > max {
+		n = max
+	}
+	taken := make([]decodedTile, n)
+	copy(taken, s.decoded)
+	s.decoded = s.decoded[n:]
+	for _, tile := range taken {
+		delete(s.inflight, tile.name)
+	}
+	return taken
+}
+
+// The number of tiles queued, being decoded or waiting to be uploaded
+func (s *tileStreamer) pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.queued) + len(s.inflight)
+}
+
+// Stops the workers, waiting for any decoding in progress to finish, and
+// drops everything queued or decoded
+func (s *tileStreamer) stop() {
+	s.lock.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	s.workers.Wait()
+
+	s.lock.Lock()
+	s.queue = nil
+	s.queued = make(map[string]*tileRequest)
+	s.decoded = nil
+	s.inflight = make(map[string]bool)
+	s.lock.Unlock()
+}
+
+func (s *tileStreamer) worker() {
+	defer s.workers.Done()
+	for {
+		s.lock.Lock()
+		for s.queue.Len() == 0 && !s.stopped {
+			s.cond.Wait()
+		}
+		if s.stopped {
+			s.lock.Unlock()
+			return
+		}
+		req := heap.Pop(&s.queue).(*tileRequest)
+		delete(s.queued, req.name)
+		s.inflight[req.name] = true
+		s.lock.Unlock()
+
+		img, meta := decodeTile(s.config(req.name))
+
+		s.lock.Lock()
+		s.decoded = append(s.decoded, decodedTile{req.name, img, meta})
+		s.lock.Unlock()
+	}
+}
+
+// Decodes the tile's area of its image file into RGBA pixels, returning nil on
+// failure
+func decodeTile(conf TileConfig) (*image.RGBA, tileMetadata) {
+	file, err := os.Open(conf.Filename)
+	if err != nil {
+		return nil, tileMetadata{}
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, tileMetadata{}
+	}
+	bounds := img.Bounds()
+	meta := sanitizeMetadata(bounds.Dx(), bounds.Dy(), conf)
+	if meta.w <= 0 || meta.h <= 0 {
+		return nil, tileMetadata{}
+	}
+	area := image.Rect(meta.x, meta.y, meta.x+meta.w, meta.y+meta.h).Add(bounds.Min)
+	if rgba, ok := img.(*image.RGBA); ok && area == bounds {
+		return rgba, meta
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, meta.w, meta.h))
+	draw.Draw(rgba, rgba.Bounds(), img, area.Min, draw.Src)
+	return rgba, meta
+}
+
+// Uploads the pixels to a new texture. Must be called on the render thread.
+func uploadTexture(img *image.RGBA) gl.Texture {
+	bounds := img.Bounds()
+	tex := gl.GenTexture()
+	tex.Bind(gl.TEXTURE_2D)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.PixelStorei(gl.UNPACK_ROW_LENGTH, img.Stride/4)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, bounds.Dx(), bounds.Dy(), 0,
+		gl.RGBA, gl.UNSIGNED_BYTE, img.Pix)
+	gl.PixelStorei(gl.UNPACK_ROW_LENGTH, 0)
+	return tex
+}